@@ -0,0 +1,300 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/go-test/deep"
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// ruleGroup is a Grafana-managed alert rule group, as returned by the
+// alerting provisioning API. Rules are kept as raw models, like dashboards.
+type ruleGroup struct {
+	Title     string                   `json:"title"`
+	FolderUID string                   `json:"folderUid"`
+	Interval  int64                    `json:"interval"`
+	Rules     []map[string]interface{} `json:"rules"`
+}
+
+type FullRuleGroup struct {
+	Group       *ruleGroup `json:"group"`
+	Datasources []*gapi.DataSource
+	Folder      *gapi.Folder
+}
+
+// ruleGroupKey identifies a rule group across instances. Folder UIDs differ
+// between instances, so the folder title is used instead.
+func ruleGroupKey(folderTitle, group string) string {
+	return folderTitle + "/" + group
+}
+
+func ruleGroupPath(folderUID, group string) string {
+	return fmt.Sprintf("/api/v1/provisioning/folder/%s/rule-groups/%s", url.PathEscape(folderUID), url.PathEscape(group))
+}
+
+// ruleGroups returns all the alert rule groups of an instance. It returns no
+// error and no groups if the instance does not have the alerting provisioning
+// API.
+func ruleGroups(api *apiClient) ([]*ruleGroup, error) {
+	rules := []map[string]interface{}{}
+	err := api.request("GET", "/api/v1/provisioning/alert-rules", nil, &rules)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []*ruleGroup{}
+	seen := make(map[string]bool)
+	for _, r := range rules {
+		folderUID, _ := r["folderUID"].(string)
+		title, _ := r["ruleGroup"].(string)
+		if seen[folderUID+"/"+title] {
+			continue
+		}
+		seen[folderUID+"/"+title] = true
+		group := &ruleGroup{}
+		err = api.request("GET", ruleGroupPath(folderUID, title), nil, group)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching rule group %s: %w", title, err)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func putRuleGroup(api *apiClient, group *ruleGroup) error {
+	return api.request("PUT", ruleGroupPath(group.FolderUID, group.Title), group, nil)
+}
+
+func deleteRuleGroup(api *apiClient, group *ruleGroup) error {
+	for _, r := range group.Rules {
+		uid, _ := r["uid"].(string)
+		err := api.request("DELETE", "/api/v1/provisioning/alert-rules/"+url.PathEscape(uid), nil, nil)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func fetchRuleGroups(client *gapi.Client, api *apiClient, basepath string, clientDS []*gapi.DataSource) error {
+	groups, err := ruleGroups(api)
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	rulesPath := filepath.Join(basepath, alertingDirectory, "rules")
+	err = os.MkdirAll(rulesPath, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("error making directory %s: %w", rulesPath, err)
+	}
+
+	for _, g := range groups {
+		folder, err := client.FolderByUID(g.FolderUID)
+		if err != nil {
+			return fmt.Errorf("error fetching folder %s: %w", g.FolderUID, err)
+		}
+
+		groupDS := []*gapi.DataSource{}
+		datasources := getRuleGroupDatasources(g)
+		for _, ds := range clientDS {
+			for _, v := range datasources {
+				if ds.UID == v {
+					groupDS = append(groupDS, &gapi.DataSource{
+						UID:  ds.UID,
+						Type: ds.Type,
+						Name: ds.Name,
+					})
+				}
+			}
+		}
+
+		data, err := json.MarshalIndent(FullRuleGroup{
+			Group:       g,
+			Folder:      folder,
+			Datasources: groupDS,
+		}, "", " ")
+		if err != nil {
+			return err
+		}
+
+		folderPath := filepath.Join(rulesPath, folder.UID)
+		err = lazyMkdir(folderPath)
+		if err != nil {
+			return fmt.Errorf("error making directory for rules in %s: %w", folder.UID, err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(folderPath, url.PathEscape(g.Title)+".json"), data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRuleGroups reads the alert rule groups fetched under basepath.
+func readRuleGroups(basepath string) ([]*FullRuleGroup, error) {
+	groups := []*FullRuleGroup{}
+	rulesPath := filepath.Join(basepath, alertingDirectory, "rules")
+	if _, err := os.Stat(rulesPath); os.IsNotExist(err) {
+		return groups, nil
+	}
+	err := filepath.Walk(rulesPath, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		group := &FullRuleGroup{}
+		err = json.Unmarshal(data, group)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, group)
+		return nil
+	})
+	return groups, err
+}
+
+// getRuleGroupDatasources returns the datasources queried by the rules of a
+// group. Rule queries reference their datasource with datasourceUid, and
+// their model can contain datasource objects like dashboards.
+func getRuleGroupDatasources(g *ruleGroup) []string {
+	uids := extractDS(reflect.ValueOf(g.Rules))
+	for _, r := range g.Rules {
+		data, _ := r["data"].([]interface{})
+		for _, d := range data {
+			if query, ok := d.(map[string]interface{}); ok {
+				if uid, ok := query["datasourceUid"].(string); ok {
+					uids = append(uids, uid)
+				}
+			}
+		}
+	}
+
+	keys := make(map[string]bool)
+	var list []string
+	for _, uid := range uids {
+		if uid == "" || isExpressionDatasource(uid) || keys[uid] {
+			continue
+		}
+		list = append(list, uid)
+		keys[uid] = true
+	}
+	return list
+}
+
+func changeRuleGroupDatasources(g *ruleGroup, in, out []*gapi.DataSource) {
+	equiv := datasourcesEquivalence(in, out)
+	changeDS(reflect.ValueOf(g.Rules), equiv)
+	for _, r := range g.Rules {
+		data, _ := r["data"].([]interface{})
+		for _, d := range data {
+			query, ok := d.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			uid, _ := query["datasourceUid"].(string)
+			if newUID, ok := equiv[uid]; ok && !isExpressionDatasource(uid) {
+				query["datasourceUid"] = newUID
+			}
+		}
+	}
+}
+
+// changeRuleGroupDashboards maps the UIDs of the dashboards that the rules of
+// a group are linked to, with the __dashboardUid__ annotation.
+func changeRuleGroupDashboards(g *ruleGroup, uid func(string) string) {
+	for _, r := range g.Rules {
+		annotations, _ := r["annotations"].(map[string]interface{})
+		if dashboardUID, ok := annotations["__dashboardUid__"].(string); ok && dashboardUID != "" {
+			annotations["__dashboardUid__"] = uid(dashboardUID)
+		}
+	}
+}
+
+// isExpressionDatasource returns true for the UIDs of the server side
+// expressions datasource, which exists in every instance.
+func isExpressionDatasource(uid string) bool {
+	return uid == "__expr__" || uid == "-100"
+}
+
+// prepareRuleGroup moves a rule group to a folder of the output instance and
+// removes the fields that are set by Grafana.
+func prepareRuleGroup(g *ruleGroup, folderUID string) {
+	g.FolderUID = folderUID
+	for _, r := range g.Rules {
+		r["folderUID"] = folderUID
+		r["ruleGroup"] = g.Title
+		delete(r, "id")
+		delete(r, "orgID")
+		delete(r, "updated")
+		delete(r, "provenance")
+	}
+}
+
+func equalRuleGroups(a, b FullRuleGroup) bool {
+	if a.Folder.Title != b.Folder.Title {
+		return false
+	}
+	if a.Group.Title != b.Group.Title || a.Group.Interval != b.Group.Interval {
+		return false
+	}
+	reset := func(g ruleGroup) []map[string]interface{} {
+		rules := make([]map[string]interface{}, len(g.Rules))
+		for i, r := range g.Rules {
+			rule := make(map[string]interface{}, len(r))
+			for k, v := range r {
+				rule[k] = v
+			}
+			for _, k := range []string{"id", "orgID", "updated", "provenance", "folderUID"} {
+				delete(rule, k)
+			}
+			rules[i] = rule
+		}
+		return rules
+	}
+	if diff := deep.Equal(reset(*a.Group), reset(*b.Group)); diff != nil {
+		return false
+	}
+	return true
+}
+
+// splitRuleGroupKey is the reverse of ruleGroupKey.
+func splitRuleGroupKey(key string) (folderTitle, group string, err error) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid rule group %q, expected <folder title>/<group>", key)
+	}
+	return key[:i], key[i+1:], nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeRuleGroupDatasources(t *testing.T) {
+	group := &ruleGroup{}
+	err := json.Unmarshal([]byte(`{"title": "group", "rules": [{"uid": "rule1", "data": [
+		{"refId": "A", "datasourceUid": "dev-prom", "model": {"datasource": {"type": "prometheus", "uid": "dev-prom"}}},
+		{"refId": "B", "datasourceUid": "__expr__", "model": {"datasource": {"type": "__expr__", "uid": "__expr__"}}}
+	]}]}`), group)
+	require.NoError(t, err)
+	require.Equal(t, []string{"dev-prom"}, getRuleGroupDatasources(group))
+
+	changeRuleGroupDatasources(group,
+		[]*gapi.DataSource{{UID: "dev-prom", Name: "Prometheus", Type: "prometheus"}},
+		[]*gapi.DataSource{{UID: "prod-prom", Name: "Prometheus", Type: "prometheus"}},
+	)
+	data := group.Rules[0]["data"].([]interface{})
+	require.Equal(t, "prod-prom", data[0].(map[string]interface{})["datasourceUid"])
+	require.Equal(t, "prod-prom", data[0].(map[string]interface{})["model"].(map[string]interface{})["datasource"].(map[string]interface{})["uid"])
+	require.Equal(t, "__expr__", data[1].(map[string]interface{})["datasourceUid"])
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// annotationConfig enables the annotations of the uploads to an output
+// instance. They are organization-wide, or on the uploaded dashboards.
+type annotationConfig struct {
+	Dashboard bool     `yaml:"dashboard"`
+	Tags      []string `yaml:"tags"`
+}
+
+// annotateUpload creates an annotation for the upload of a dashboard, tagged
+// with dashboard-manager, the source instance and the dashboard UID. previous
+// is the dashboard before the upload, if it existed.
+func annotateUpload(client *gapi.Client, cfg *annotationConfig, r *promotionRecord, dashboardID int64, uid string, previous, uploaded *gapi.Dashboard) error {
+	title, _ := getTitle(uploaded)
+	text := fmt.Sprintf("Dashboard %s uploaded from %s version %d", title, r.Source, r.SourceVersion)
+	if changes := changeSummary(previous, uploaded); len(changes) > 0 {
+		text += ":\n" + strings.Join(changes, "\n")
+	}
+
+	a := &gapi.Annotation{
+		Time: time.Now().UnixNano() / int64(time.Millisecond),
+		Text: text,
+		Tags: append([]string{managedTag, r.Source, uid}, cfg.Tags...),
+	}
+	if cfg.Dashboard {
+		a.DashboardID = dashboardID
+	}
+	_, err := client.NewAnnotation(a)
+	return err
+}
+
+// changeSummary lists the panels and variables added, removed or changed in
+// a dashboard.
+func changeSummary(previous, uploaded *gapi.Dashboard) []string {
+	if previous == nil {
+		return []string{"new dashboard"}
+	}
+	changes := []string{}
+	if oldTitle, _ := getTitle(previous); oldTitle != "" {
+		if newTitle, _ := getTitle(uploaded); newTitle != oldTitle {
+			changes = append(changes, fmt.Sprintf("renamed from %s", oldTitle))
+		}
+	}
+
+	changes = append(changes, itemChanges("panel", dashboardPanels(previous.Model), dashboardPanels(uploaded.Model), "id", "title")...)
+	changes = append(changes, itemChanges("variable", dashboardVariables(previous.Model), dashboardVariables(uploaded.Model), "name", "name")...)
+	return changes
+}
+
+// itemChanges lists the items added, removed or changed.
+func itemChanges(kind string, previous, uploaded []interface{}, idKey, nameKey string) []string {
+	changes := []string{}
+	oldItems, oldOrder := summaryItems(previous, idKey, nameKey)
+	newItems, newOrder := summaryItems(uploaded, idKey, nameKey)
+	for _, name := range newOrder {
+		old, ok := oldItems[name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("added %s %s", kind, name))
+		case !reflect.DeepEqual(old, newItems[name]):
+			changes = append(changes, fmt.Sprintf("changed %s %s", kind, name))
+		}
+	}
+	for _, name := range oldOrder {
+		if _, ok := newItems[name]; !ok {
+			changes = append(changes, fmt.Sprintf("removed %s %s", kind, name))
+		}
+	}
+	return changes
+}
+
+// summaryItems indexes items by their display name, which is the value of
+// nameKey, or of idKey for items without names.
+func summaryItems(items []interface{}, idKey, nameKey string) (map[string]interface{}, []string) {
+	indexed := make(map[string]interface{})
+	order := []string{}
+	for _, i := range items {
+		m, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := m[nameKey].(string)
+		if name == "" {
+			name = fmt.Sprint(m[idKey])
+		}
+		indexed[name] = m
+		order = append(order, name)
+	}
+	return indexed, order
+}
+
+// dashboardPanels returns the panels of a dashboard, including the ones in
+// collapsed rows.
+func dashboardPanels(model map[string]interface{}) []interface{} {
+	panels, _ := model["panels"].([]interface{})
+	all := []interface{}{}
+	for _, p := range panels {
+		all = append(all, p)
+		if m, ok := p.(map[string]interface{}); ok {
+			if nested, ok := m["panels"].([]interface{}); ok {
+				all = append(all, nested...)
+			}
+		}
+	}
+	return all
+}
+
+func dashboardVariables(model map[string]interface{}) []interface{} {
+	templating, _ := model["templating"].(map[string]interface{})
+	variables, _ := templating["list"].([]interface{})
+	return variables
+}
@@ -0,0 +1,38 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeSummary(t *testing.T) {
+	dashboard := func(s string) *gapi.Dashboard {
+		return &gapi.Dashboard{Model: mustModel(t, s)}
+	}
+	previous := dashboard(`{"title": "Nodes", "panels": [{"id": 1, "title": "CPU"}, {"id": 2, "title": "Memory"}],
+		"templating": {"list": [{"name": "instance"}]}}`)
+	uploaded := dashboard(`{"title": "Nodes", "panels": [{"id": 1, "title": "CPU", "type": "timeseries"}, {"id": 3, "title": "Disk"}],
+		"templating": {"list": [{"name": "instance"}, {"name": "job"}]}}`)
+
+	require.Equal(t, []string{"new dashboard"}, changeSummary(nil, uploaded))
+	require.Equal(t, []string{
+		"changed panel CPU",
+		"added panel Disk",
+		"removed panel Memory",
+		"added variable job",
+	}, changeSummary(previous, uploaded))
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// apiClient talks to the Grafana HTTP API endpoints that are not covered by
+// the Grafana client library, e.g. the alerting provisioning API. It
+// authenticates the same way as the Grafana client library.
+type apiClient struct {
+	baseURL url.URL
+	config  gapi.Config
+	client  *http.Client
+}
+
+func newAPIClient(baseURL string, cfg gapi.Config) (*apiClient, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BasicAuth != nil {
+		u.User = cfg.BasicAuth
+	}
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &apiClient{
+		baseURL: *u,
+		config:  cfg,
+		client:  client,
+	}, nil
+}
+
+// request sends body, encoded as JSON, to the given path and decodes the JSON
+// response into response, unless it is nil. Errors are formatted like the
+// Grafana client library errors, so isNotFound can be used on them.
+func (c *apiClient) request(method, requestPath string, body, response interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	u := c.baseURL
+	u.Path = path.Join(u.Path, requestPath)
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return err
+	}
+	if c.config.APIKey != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.config.APIKey))
+	} else if c.config.OrgID != 0 {
+		req.Header.Add("X-Grafana-Org-Id", strconv.FormatInt(c.config.OrgID, 10))
+	}
+	for k, v := range c.config.HTTPHeaders {
+		req.Header.Add(k, v)
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bodyContents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status: %d, body: %v", resp.StatusCode, string(bodyContents))
+	}
+	if response == nil || len(bodyContents) == 0 {
+		return nil
+	}
+	return json.Unmarshal(bodyContents, response)
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+const (
+	authNone           = ""
+	authAPIKey         = "api_key"
+	authServiceAccount = "service_account"
+	authBasic          = "basic_auth"
+	authExec           = "exec"
+)
+
+type basicAuthConfig struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// execAuthConfig is a credential helper: a command which prints a token on
+// its standard output.
+type execAuthConfig struct {
+	Command []string `yaml:"command"`
+
+	// token caches the token, the command is run once per run.
+	token string
+}
+
+// authModes returns the authentication modes configured for the instance.
+func (g *grafanaInstance) authModes() []string {
+	var modes []string
+	if g.Auth != "" || g.AuthFile != "" {
+		modes = append(modes, authAPIKey)
+	}
+	if g.ServiceAccountToken != "" || g.ServiceAccountTokenFile != "" {
+		modes = append(modes, authServiceAccount)
+	}
+	if g.BasicAuth != nil {
+		modes = append(modes, authBasic)
+	}
+	if g.Exec != nil {
+		modes = append(modes, authExec)
+	}
+	return modes
+}
+
+func (g *grafanaInstance) authMode() string {
+	modes := g.authModes()
+	if len(modes) == 0 {
+		return authNone
+	}
+	return modes[0]
+}
+
+// validateAuth checks that at most one authentication mode is configured,
+// and that it is complete.
+func (g *grafanaInstance) validateAuth() error {
+	modes := g.authModes()
+	if len(modes) > 1 {
+		return fmt.Errorf("instance %s: only one of %s can be configured", g.Name, strings.Join(modes, ", "))
+	}
+	if g.Auth != "" && g.AuthFile != "" {
+		return fmt.Errorf("instance %s: only one of api_key and api_key_file can be configured", g.Name)
+	}
+	if g.ServiceAccountToken != "" && g.ServiceAccountTokenFile != "" {
+		return fmt.Errorf("instance %s: only one of service_account_token and service_account_token_file can be configured", g.Name)
+	}
+	if g.BasicAuth != nil {
+		if g.BasicAuth.Username == "" {
+			return fmt.Errorf("instance %s: basic_auth requires a username", g.Name)
+		}
+		if (g.BasicAuth.Password == "") == (g.BasicAuth.PasswordFile == "") {
+			return fmt.Errorf("instance %s: basic_auth requires one of password and password_file", g.Name)
+		}
+	}
+	if g.Exec != nil && len(g.Exec.Command) == 0 {
+		return fmt.Errorf("instance %s: exec requires a command", g.Name)
+	}
+	return nil
+}
+
+// readSecret returns value, or the content of file if it is set.
+func readSecret(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	fileContent, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(fileContent)), nil
+}
+
+func execToken(cfg *execAuthConfig) (string, error) {
+	if cfg.token != "" {
+		return cfg.token, nil
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(cfg.Command[0], cfg.Command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("error running credential helper %s: %w: %s", cfg.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	token := strings.TrimSpace(stdout.String())
+	if token == "" {
+		return "", fmt.Errorf("credential helper %s did not print a token", cfg.Command[0])
+	}
+	cfg.token = token
+	return token, nil
+}
+
+// setAuth sets the credentials of the instance in the client configuration.
+func (g *grafanaInstance) setAuth(cfg *gapi.Config) error {
+	var err error
+	switch g.authMode() {
+	case authAPIKey:
+		cfg.APIKey, err = readSecret(g.Auth, g.AuthFile)
+	case authServiceAccount:
+		cfg.APIKey, err = readSecret(g.ServiceAccountToken, g.ServiceAccountTokenFile)
+		// Service account tokens are bound to an organization. Sending it
+		// anyway makes Grafana fail if the token belongs to another one.
+		if err == nil && g.org != nil {
+			cfg.HTTPHeaders = map[string]string{
+				"X-Grafana-Org-Id": strconv.FormatInt(g.org.ID, 10),
+			}
+		}
+	case authBasic:
+		var password string
+		password, err = readSecret(g.BasicAuth.Password, g.BasicAuth.PasswordFile)
+		cfg.BasicAuth = url.UserPassword(g.BasicAuth.Username, password)
+	case authExec:
+		cfg.APIKey, err = execToken(g.Exec)
+	}
+	if err != nil {
+		return err
+	}
+	if cfg.APIKey == "" && cfg.BasicAuth == nil && g.authMode() != authNone {
+		return fmt.Errorf("instance %s: empty credentials", g.Name)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAuth(t *testing.T) {
+	for _, tc := range []struct {
+		instance grafanaInstance
+		valid    bool
+	}{
+		{instance: grafanaInstance{}, valid: true},
+		{instance: grafanaInstance{AuthFile: "secret"}, valid: true},
+		{instance: grafanaInstance{ServiceAccountTokenFile: "token"}, valid: true},
+		{instance: grafanaInstance{BasicAuth: &basicAuthConfig{Username: "admin", Password: "admin"}}, valid: true},
+		{instance: grafanaInstance{Exec: &execAuthConfig{Command: []string{"echo", "token"}}}, valid: true},
+		{instance: grafanaInstance{Auth: "key", ServiceAccountToken: "token"}, valid: false},
+		{instance: grafanaInstance{Auth: "key", AuthFile: "secret"}, valid: false},
+		{instance: grafanaInstance{BasicAuth: &basicAuthConfig{Password: "admin"}}, valid: false},
+		{instance: grafanaInstance{BasicAuth: &basicAuthConfig{Username: "admin"}}, valid: false},
+		{instance: grafanaInstance{Exec: &execAuthConfig{}}, valid: false},
+	} {
+		err := tc.instance.validateAuth()
+		if tc.valid {
+			require.NoError(t, err)
+		} else {
+			require.Error(t, err)
+		}
+	}
+}
+
+func TestExecToken(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "runs")
+	cfg := &execAuthConfig{Command: []string{"sh", "-c", "echo run >> " + counter + "; echo token"}}
+	for i := 0; i < 2; i++ {
+		token, err := execToken(cfg)
+		require.NoError(t, err)
+		require.Equal(t, "token", token)
+	}
+	runs, err := ioutil.ReadFile(counter)
+	require.NoError(t, err)
+	require.Equal(t, "run\n", string(runs))
+}
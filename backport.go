@@ -0,0 +1,246 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// backportDashboards fetches dashboards from an output instance and maps
+// their datasources and folders back to the input instance, so that changes
+// made in the output instance are not lost at the next upload. The
+// dashboards are written in the dashboards directory, or uploaded to the
+// input instance.
+func backportDashboards(cfg *config) error {
+	input := cfg.instance(cfg.Input, *backportSource)
+	if input == nil {
+		return errors.New("input instance not found")
+	}
+	output := cfg.instance(cfg.Output, *backportOutput)
+	if output == nil {
+		return errors.New("output instance not found")
+	}
+	if input.Jsonnet != nil {
+		return fmt.Errorf("dashboards of %s are evaluated from jsonnet and can not be backported", input.Name)
+	}
+
+	inputInstance, err := input.orgInstance(*backportSourceOrg)
+	if err != nil {
+		return err
+	}
+	outputInstance, err := output.outputOrgInstance(*backportOutputOrg, inputInstance)
+	if err != nil {
+		return err
+	}
+
+	inputClient, err := inputInstance.client()
+	if err != nil {
+		return err
+	}
+	outputClient, err := outputInstance.client()
+	if err != nil {
+		return err
+	}
+	inputDS := clientDatasources(inputClient)
+	outputDS := clientDatasources(outputClient)
+
+	state, err := loadState(cfg.StateFile)
+	if err != nil {
+		return err
+	}
+
+	basepath := inputInstance.path(*backportDirectory)
+	inputUIDs, err := inputDashboardUIDs(inputInstance, outputInstance, *backportDirectory, *backportDashboardsList)
+	if err != nil {
+		return err
+	}
+	for _, uid := range *backportDashboardsList {
+		outputUID := outputInstance.dashboardUID(inputInstance, uid)
+		board, err := outputClient.DashboardByUID(outputUID)
+		if err != nil {
+			return fmt.Errorf("error fetching %s: %w", outputUID, err)
+		}
+		outputVersion := dashboardVersion(board)
+		unstampDashboard(board)
+		base, err := baseModel(board.Model)
+		if err != nil {
+			return err
+		}
+
+		dashboard, err := fullDashboard(outputClient, outputDS, board)
+		if err != nil {
+			return err
+		}
+		err = backportDashboard(inputInstance, outputInstance, inputClient, inputDS, dashboard, inputUIDs)
+		if err != nil {
+			return fmt.Errorf("error backporting %s: %w", uid, err)
+		}
+
+		r, err := newPromotionRecord(inputInstance, dashboard)
+		if err != nil {
+			return err
+		}
+		r.OutputVersion = outputVersion
+		r.Base = base
+
+		if *backportUpload {
+			_, err = uploadDashboard(inputClient, inputDS, *dashboard)
+		} else {
+			err = replaceDashboard(basepath, uid, dashboard)
+		}
+		if err != nil {
+			return err
+		}
+
+		// The output dashboard is now the source of the input dashboard.
+		err = state.record(outputInstance, outputUID, r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inputDashboardUIDs maps the UIDs of dashboards in an output instance to
+// their UIDs in the input instance. Hashed UIDs can not be reversed, so the
+// map is built from the dashboards of the input instance. Generated
+// dashboards can not be backported: they would be written next to their
+// template and collide with the generated ones. Neither can dashboards with
+// placeholders or overlays for the output instance, whose values and changes
+// would replace the ones of the input instance.
+func inputDashboardUIDs(input, output grafanaInstance, directory string, uids []string) (map[string]string, error) {
+	inputUIDs := make(map[string]string)
+	backported := make(map[string]bool)
+	for _, uid := range uids {
+		inputUIDs[output.dashboardUID(input, uid)] = uid
+		backported[uid] = true
+	}
+	dashboards, err := input.dashboards(directory)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, d := range dashboards {
+		uid, err := getUID(d.Dashboard)
+		if err != nil {
+			return nil, err
+		}
+		if backported[uid] {
+			refusal, err := backportRefusal(output, d)
+			if err != nil {
+				return nil, err
+			}
+			if refusal != "" {
+				return nil, fmt.Errorf("dashboard %s %s and can not be backported", uid, refusal)
+			}
+		}
+		inputUIDs[output.dashboardUID(input, uid)] = uid
+	}
+	return inputUIDs, nil
+}
+
+// backportRefusal returns why the dashboard of an output instance can not be
+// backported, if it is not the dashboard of the input instance as it is.
+func backportRefusal(output grafanaInstance, d *FullDashboard) (string, error) {
+	if d.template != "" {
+		return "is generated from " + d.template, nil
+	}
+	placeholders := hasPlaceholders(d.Dashboard.Model)
+	for _, p := range d.LibraryPanels {
+		placeholders = placeholders || hasPlaceholders(p.Model)
+	}
+	if placeholders {
+		return "has template placeholders", nil
+	}
+	overlays, err := output.hasOverlays(d)
+	if err != nil {
+		return "", err
+	}
+	if overlays {
+		return "has overlays for " + output.Name, nil
+	}
+	return "", nil
+}
+
+// backportDashboard changes the UID, the datasources, the links and the
+// folder of a dashboard of an output instance to their equivalents in the
+// input instance.
+func backportDashboard(input, output grafanaInstance, inputClient *gapi.Client, inputDS []*gapi.DataSource, dashboard *FullDashboard, inputUIDs map[string]string) error {
+	inputUID := func(uid string) string {
+		if u, ok := inputUIDs[uid]; ok {
+			return u
+		}
+		return uid
+	}
+	uid, err := getUID(dashboard.Dashboard)
+	if err != nil {
+		return err
+	}
+	dashboard.Dashboard.Model["uid"] = inputUID(uid)
+	if output.ReadOnly {
+		delete(dashboard.Dashboard.Model, "editable")
+	}
+
+	equiv := datasourcesEquivalence(dashboard.Datasources, inputDS)
+	for _, ds := range dashboard.Datasources {
+		if _, ok := equiv[ds.UID]; !ok {
+			fmt.Printf("Datasource %s (%s) not found in the input instance.\n", ds.Name, ds.Type)
+		}
+	}
+	changeDatasources(dashboard.Dashboard, dashboard.Datasources, inputDS)
+	for _, p := range dashboard.LibraryPanels {
+		changeLibraryPanelDatasources(p, dashboard.Datasources, inputDS)
+	}
+	dashboard.Datasources = dashboardDatasources(inputDS, getAllDatasources(dashboard.Dashboard, dashboard.LibraryPanels))
+	newLinkRewriter(output, input, inputUID).rewriteDashboard(dashboard)
+
+	if dashboard.Folder == nil || dashboard.Folder.ID == 0 {
+		return nil
+	}
+	folders, err := inputClient.Folders()
+	if err != nil {
+		return err
+	}
+	for i := range folders {
+		if folders[i].Title == dashboard.Folder.Title {
+			dashboard.Folder = &folders[i]
+			return nil
+		}
+	}
+	// The folder is created by title when the dashboard is uploaded.
+	return nil
+}
+
+// replaceDashboard writes a dashboard in the dashboards directory of an
+// input instance, removing the previous version if it was in another folder.
+func replaceDashboard(basepath, uid string, dashboard *FullDashboard) error {
+	previous, err := filepath.Glob(filepath.Join(basepath, "*", uid+".json"))
+	if err != nil {
+		return err
+	}
+	for _, p := range previous {
+		err = os.Remove(p)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.MkdirAll(basepath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return writeDashboard(basepath, dashboard)
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackportRefusal(t *testing.T) {
+	dir := t.TempDir()
+	input := grafanaInstance{Name: "dev"}
+	output := grafanaInstance{Name: "prod", ReadOnly: true}
+	mustWriteDashboard(t, dir, "dev", mustModel(t, `{"uid": "nodes", "editable": true}`))
+	mustWriteDashboard(t, dir, "dev", mustModel(t, `{"uid": "pods", "title": "Pods in %{cluster}"}`))
+	mustWriteDashboard(t, dir, "dev", mustModel(t, `{"uid": "disks"}`))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "dev", "general", "disks.prod.merge.json"), []byte(`{"refresh": "1m"}`), 0644))
+
+	_, err := inputDashboardUIDs(input, output, dir, []string{"pods"})
+	require.EqualError(t, err, "dashboard pods has template placeholders and can not be backported")
+	_, err = inputDashboardUIDs(input, output, dir, []string{"disks"})
+	require.EqualError(t, err, "dashboard disks has overlays for prod and can not be backported")
+	uids, err := inputDashboardUIDs(input, output, dir, []string{"nodes"})
+	require.NoError(t, err)
+
+	// Read-only outputs make dashboards not editable, which is not kept.
+	d := &FullDashboard{Dashboard: &gapi.Dashboard{Model: mustModel(t, `{"uid": "nodes", "editable": false}`)}}
+	require.NoError(t, backportDashboard(input, output, nil, nil, d, uids))
+	require.Equal(t, mustModel(t, `{"uid": "nodes"}`), mustRoundTrip(t, d.Dashboard.Model))
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+type checkResult struct {
+	Instance string
+	Org      string
+	Check    string
+	Result   string
+	Problem  bool
+}
+
+// checkInstances connects to every instance and checks that dashboard-manager
+// can do its job there. Output instances are also checked for write access,
+// by creating and deleting a folder and a dashboard.
+func checkInstances(cfg *config) error {
+	results := []checkResult{}
+	for _, instances := range []struct {
+		list   []grafanaInstance
+		output bool
+	}{{cfg.Input, false}, {cfg.Output, true}} {
+		for _, instance := range instances.list {
+			orgInstances, err := instance.orgInstances()
+			if err != nil {
+				results = append(results, checkResult{Instance: instance.Name, Check: "organizations", Result: err.Error(), Problem: true})
+				continue
+			}
+			for _, orgInstance := range orgInstances {
+				results = append(results, checkInstance(orgInstance, instances.output)...)
+			}
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tORG\tCHECK\tRESULT")
+	var problems int
+	for _, r := range results {
+		result := r.Result
+		if r.Problem {
+			problems++
+			result = "FAIL: " + result
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Instance, r.Org, r.Check, result)
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	return nil
+}
+
+func checkInstance(instance grafanaInstance, output bool) []checkResult {
+	results := []checkResult{}
+	orgName := instance.orgName()
+	add := func(check, result string, err error) {
+		r := checkResult{Instance: instance.Name, Org: orgName, Check: check, Result: result}
+		if err != nil {
+			r.Result = err.Error()
+			r.Problem = true
+		}
+		results = append(results, r)
+	}
+
+	client, err := instance.client()
+	if err != nil {
+		add("connection", "", err)
+		return results
+	}
+	api, err := instance.api()
+	if err != nil {
+		add("connection", "", err)
+		return results
+	}
+
+	// The health endpoint does not need credentials, they are checked by
+	// reading the organization.
+	var health struct {
+		Version string `json:"version"`
+	}
+	err = api.request("GET", "/api/health", nil, &health)
+	add("grafana version", health.Version, err)
+	if err != nil {
+		return results
+	}
+
+	var org struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	}
+	err = api.request("GET", "/api/org", nil, &org)
+	add("credentials", fmt.Sprintf("organization %s (%d)", org.Name, org.ID), err)
+	if err != nil {
+		return results
+	}
+	orgName = org.Name
+
+	// Since Grafana 8.3, replacing the datasources of dashboards needs admin
+	// credentials.
+	role, err := credentialsRole(api, org.ID)
+	if err == nil && role != "Admin" {
+		err = fmt.Errorf("%s, Admin is required", role)
+	}
+	add("role", role, err)
+
+	var datasources []map[string]interface{}
+	err = api.request("GET", "/api/datasources", nil, &datasources)
+	add("list datasources", fmt.Sprintf("%d datasources", len(datasources)), err)
+
+	folders, err := client.Folders()
+	add("read folders", fmt.Sprintf("%d folders", len(folders)), err)
+
+	dashboards, err := client.Dashboards()
+	add("read dashboards", fmt.Sprintf("%d dashboards", len(dashboards)), err)
+
+	if output {
+		add("write folders and dashboards", "ok", checkWrite(client))
+	}
+	return results
+}
+
+// credentialsRole returns the role of the credentials in the organization.
+// The role of API keys and service account tokens can not be read back, so
+// they are checked with a request only allowed to admins.
+func credentialsRole(api *apiClient, orgID int64) (string, error) {
+	var orgs []struct {
+		OrgID int64  `json:"orgId"`
+		Role  string `json:"role"`
+	}
+	err := api.request("GET", "/api/user/orgs", nil, &orgs)
+	if err == nil {
+		for _, o := range orgs {
+			if o.OrgID == orgID {
+				return o.Role, nil
+			}
+		}
+		return "", fmt.Errorf("not a member of organization %d", orgID)
+	}
+
+	err = api.request("GET", "/api/org/users", nil, nil)
+	if isForbidden(err) {
+		return "not Admin", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("not verified: %w", err)
+	}
+	return "Admin", nil
+}
+
+func checkWrite(client *gapi.Client) error {
+	folder, err := client.NewFolder(fmt.Sprintf("dashboard-manager check %d", time.Now().Unix()))
+	if err != nil {
+		return fmt.Errorf("error creating folder: %w", err)
+	}
+	_, err = client.NewDashboard(gapi.Dashboard{
+		Model: map[string]interface{}{
+			"title": "dashboard-manager check",
+		},
+		Folder: folder.ID,
+	})
+	if err != nil {
+		_ = client.DeleteFolder(folder.UID)
+		return fmt.Errorf("error creating dashboard: %w", err)
+	}
+	err = client.DeleteFolder(folder.UID)
+	if err != nil {
+		return fmt.Errorf("error deleting folder %s: %w", folder.Title, err)
+	}
+	return nil
+}
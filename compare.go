@@ -15,9 +15,8 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/fs"
 	"io/ioutil"
-	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/go-test/deep"
@@ -25,144 +24,369 @@ import (
 	gapi "github.com/grafana/grafana-api-golang-client"
 )
 
+const (
+	kindDashboard      = "dashboard"
+	kindAlertRuleGroup = "alert-rule-group"
+
+	kindContactPoint         = "contact-point"
+	kindMuteTiming           = "mute-timing"
+	kindNotificationPolicies = "notification-policies"
+)
+
 type dashboardDiff struct {
-	Source string   `json:"source"`
-	UID    string   `json:"uid"`
-	Action string   `json:"action"`
-	Title  string   `json:"title"`
-	Tags   []string `json:"tags"`
-	Diff   string   `json:"diff"`
+	Kind      string `json:"kind"`
+	Source    string `json:"source"`
+	SourceOrg string `json:"source_org,omitempty"`
+	OutputOrg string `json:"output_org,omitempty"`
+	UID       string `json:"uid"`
+	// OutputUID is the UID of the dashboard in the output instance, when
+	// it is mapped to another UID.
+	OutputUID string   `json:"output_uid,omitempty"`
+	Action    string   `json:"action"`
+	Title     string   `json:"title"`
+	Tags      []string `json:"tags"`
+	Diff      string   `json:"diff"`
+	// Conflicts are the paths which can not be merged, for drifted
+	// dashboards.
+	Conflicts []string `json:"conflicts,omitempty"`
 }
 
 type diff map[string][]dashboardDiff
 
 func compareDashboards(cfg *config) error {
+	state, err := loadState(cfg.StateFile)
+	if err != nil {
+		return err
+	}
 	output := make(diff, 0)
-	for _, outputInstance := range cfg.Output {
-		output[outputInstance.Name] = []dashboardDiff{}
-		client, err := outputInstance.client()
-		if err != nil {
-			return err
-		}
-		dashboards, err := client.Dashboards()
+	for _, instance := range cfg.Output {
+		output[instance.Name] = []dashboardDiff{}
+		orgInstances, err := instance.orgInstances()
 		if err != nil {
 			return err
 		}
-
-		clientDS := []*gapi.DataSource{}
-		// Hard code limit to 50 for now.
-		for i := int64(0); i < 50; i++ {
-			ds, err := client.DataSource(i)
-			if err == nil {
-				clientDS = append(clientDS, ds)
+		for _, outputInstance := range orgInstances {
+			diffs, err := compareOutput(cfg, state, outputInstance)
+			if err != nil {
+				return err
 			}
+			output[instance.Name] = append(output[instance.Name], diffs...)
 		}
+	}
+	data, err := json.MarshalIndent(output, "", " ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(*compareResults, data, 0644)
+	if err != nil {
+		return err
+	}
+	return nil
+}
 
-		for _, instance := range cfg.Input {
-			basepath := filepath.Join(*compareDirectory, instance.Name)
-			err = filepath.Walk(basepath, func(path string, info fs.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if info.IsDir() {
-					return nil
-				}
-				data, err := ioutil.ReadFile(path)
-				if err != nil {
-					return err
-				}
-				localDashboard := &FullDashboard{}
-				err = json.Unmarshal(data, localDashboard)
-				if err != nil {
-					return err
-				}
+// compareOutput compares an output instance, or one of its organizations,
+// with the input instances uploaded to it. Dashboards changed in the output
+// instance since they were uploaded are reported as drifted.
+func compareOutput(cfg *config, state *promotionState, outputInstance grafanaInstance) ([]dashboardDiff, error) {
+	diffs := []dashboardDiff{}
+	client, err := outputInstance.client()
+	if err != nil {
+		return nil, err
+	}
+	dashboards, err := client.Dashboards()
+	if err != nil {
+		return nil, err
+	}
 
-				changeDatasources(localDashboard.Dashboard, localDashboard.Datasources, clientDS)
+	clientDS := clientDatasources(client)
 
-				tags := sanitizeTags(getTags(localDashboard.Dashboard))
+	inputs, err := cfg.inputsFor(outputInstance)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := cfg.dashboardClaims(outputInstance, *compareDirectory)
+	if err != nil {
+		return nil, err
+	}
+	var principal int64
+	if outputInstance.ReadOnly {
+		principal, err = outputInstance.principal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, instance := range inputs {
+		localDashboards, err := instance.dashboards(*compareDirectory)
+		if err != nil {
+			return nil, fmt.Errorf("error reading dashboards: %w", err)
+		}
+		for _, localDashboard := range localDashboards {
+			sourceUID, err := getUID(localDashboard.Dashboard)
+			if err != nil {
+				return nil, fmt.Errorf("error comparing dashboards: %w", err)
+			}
+			err = outputInstance.prepareDashboard(instance, localDashboard)
+			if err != nil {
+				return nil, err
+			}
+			changeDatasources(localDashboard.Dashboard, localDashboard.Datasources, clientDS)
+			for _, p := range localDashboard.LibraryPanels {
+				changeLibraryPanelDatasources(p, localDashboard.Datasources, clientDS)
+			}
 
-				if !outputInstance.shouldIncludeDashboard(localDashboard.Dashboard) {
-					return nil
-				}
+			tags := sanitizeTags(getTags(localDashboard.Dashboard))
 
-				var found bool
-				for _, d := range dashboards {
-					uid, err := getUID(localDashboard.Dashboard)
-					if err != nil {
-						return err
-					}
-					if d.UID == uid {
-						found = true
-						break
-					}
-				}
-				if !found {
-					title, err := getTitle(localDashboard.Dashboard)
-					if err != nil {
-						return err
-					}
-					uid, err := getUID(localDashboard.Dashboard)
-					if err != nil {
-						return err
-					}
+			if !outputInstance.shouldIncludeDashboard(localDashboard.Dashboard) {
+				continue
+			}
 
-					fmt.Printf("Dashboard %s (%s) is new.\n", title, uid)
-					output[outputInstance.Name] = append(output[outputInstance.Name], dashboardDiff{
-						Action: "new",
-						Source: instance.Name,
-						UID:    uid,
-						Title:  title,
-						Tags:   tags,
-					})
-					return nil
-				}
+			uid, err := getUID(localDashboard.Dashboard)
+			if err != nil {
+				return nil, fmt.Errorf("error comparing dashboards: %w", err)
+			}
+			title, err := getTitle(localDashboard.Dashboard)
+			if err != nil {
+				return nil, fmt.Errorf("error comparing dashboards: %w", err)
+			}
 
-				uid, err := getUID(localDashboard.Dashboard)
-				if err != nil {
-					return err
+			collision, skip := claims.ownerDiff(outputInstance, instance, uid, dashboardDiff{
+				Kind:      kindDashboard,
+				Source:    instance.Name,
+				SourceOrg: instance.orgName(),
+				UID:       sourceUID,
+				OutputUID: mappedUID(sourceUID, uid),
+				Title:     title,
+				Tags:      tags,
+			})
+			if collision != nil {
+				diffs = append(diffs, *collision)
+			}
+			if skip {
+				continue
+			}
+
+			var found, managed bool
+			for _, d := range dashboards {
+				if d.UID == uid {
+					found = true
+					managed = isManaged(d.Tags) || state.get(outputInstance, uid) != nil
+					break
 				}
-				title, err := getTitle(localDashboard.Dashboard)
+			}
+			if found && !managed {
+				fmt.Printf("Dashboard %s (%s) is not managed by dashboard-manager.\n", title, uid)
+				diffs = append(diffs, dashboardDiff{
+					Kind:      kindDashboard,
+					Action:    "unmanaged",
+					Source:    instance.Name,
+					SourceOrg: instance.orgName(),
+					UID:       sourceUID,
+					OutputUID: mappedUID(sourceUID, uid),
+					Title:     title,
+					Tags:      tags,
+				})
+				continue
+			}
+			if !found {
+				fmt.Printf("Dashboard %s (%s) is new.\n", title, uid)
+				diffs = append(diffs, dashboardDiff{
+					Kind:      kindDashboard,
+					Action:    "new",
+					Source:    instance.Name,
+					SourceOrg: instance.orgName(),
+					UID:       sourceUID,
+					OutputUID: mappedUID(sourceUID, uid),
+					Title:     title,
+					Tags:      tags,
+				})
+				continue
+			}
+
+			outputDashboard, err := fetchOutputDashboard(client, uid, localDashboard)
+			if err != nil {
+				return nil, fmt.Errorf("error comparing dashboards: %w", err)
+			}
+			if outputInstance.ReadOnly {
+				makeReadOnly(localDashboard.Dashboard)
+				problem, err := checkProtection(client, principal, outputDashboard.Dashboard)
 				if err != nil {
-					return err
+					return nil, fmt.Errorf("error checking protection of %s: %w", uid, err)
 				}
-				board, err := client.DashboardByUID(uid)
-				if err != nil {
-					return err
+				if problem != "" {
+					fmt.Printf("Dashboard %s (%s) is not protected: %s.\n", title, uid, problem)
+					diffs = append(diffs, dashboardDiff{
+						Kind:      kindDashboard,
+						Action:    "unprotected",
+						Source:    instance.Name,
+						SourceOrg: instance.orgName(),
+						UID:       sourceUID,
+						OutputUID: mappedUID(sourceUID, uid),
+						Title:     title,
+						Tags:      tags,
+						Diff:      problem,
+					})
 				}
-				folder, err := client.Folder(board.Meta.Folder)
-				if err != nil {
-					return err
+			}
+			action := "modify"
+			var conflicts []string
+			if state.drifted(outputInstance, uid, outputDashboard.Dashboard) {
+				action = "drifted"
+				if base := state.get(outputInstance, uid).Base; base != nil {
+					_, conflicts, err = mergeDashboards(base, localDashboard.Dashboard.Model, outputDashboard.Dashboard.Model, mergeResolver{})
+					if err != nil {
+						return nil, fmt.Errorf("error merging %s: %w", uid, err)
+					}
 				}
+			}
+			if !equalDashboards(*localDashboard, outputDashboard) {
+				fmt.Printf("Dashboard %s (%s) is different.\n", title, uid)
+				diffs = append(diffs, dashboardDiff{
+					Kind:      kindDashboard,
+					Action:    action,
+					Source:    instance.Name,
+					SourceOrg: instance.orgName(),
+					UID:       sourceUID,
+					OutputUID: mappedUID(sourceUID, uid),
+					Title:     title,
+					Tags:      tags,
+					Diff:      cmp.Diff(*localDashboard, outputDashboard),
+					Conflicts: conflicts,
+				})
+			}
+		}
+	}
 
-				outputDashboard := FullDashboard{Dashboard: board, Folder: folder}
-				if !equalDashboards(*localDashboard, outputDashboard) {
-					fmt.Printf("Dashboard %s (%s) is different.\n", title, uid)
-					output[outputInstance.Name] = append(output[outputInstance.Name], dashboardDiff{
-						Action: "modify",
-						Source: instance.Name,
-						UID:    uid,
-						Title:  title,
-						Tags:   tags,
-						Diff:   cmp.Diff(*localDashboard, outputDashboard),
-					})
-				}
+	ruleDiffs, err := compareRuleGroups(inputs, outputInstance, client, clientDS)
+	if err != nil {
+		return nil, fmt.Errorf("error comparing alert rules: %w", err)
+	}
+	diffs = append(diffs, ruleDiffs...)
+
+	notificationDiffs, err := compareNotifications(inputs, outputInstance)
+	if err != nil {
+		return nil, fmt.Errorf("error comparing notifications: %w", err)
+	}
+	diffs = append(diffs, notificationDiffs...)
 
-				return nil
+	for i := range diffs {
+		diffs[i].OutputOrg = outputInstance.orgName()
+	}
+	return diffs, nil
+}
+
+// compareRuleGroups compares the alert rule groups of the input instances
+// with the ones of an output instance. Rule groups are identified by
+// ruleGroupKey.
+func compareRuleGroups(inputs []grafanaInstance, outputInstance grafanaInstance, client *gapi.Client, clientDS []*gapi.DataSource) ([]dashboardDiff, error) {
+	diffs := []dashboardDiff{}
+	api, err := outputInstance.api()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := ruleGroups(api)
+	if err != nil {
+		return nil, err
+	}
+	outputGroups := make(map[string]FullRuleGroup)
+	for _, g := range groups {
+		folder, err := client.FolderByUID(g.FolderUID)
+		if err != nil {
+			return nil, err
+		}
+		outputGroups[ruleGroupKey(folder.Title, g.Title)] = FullRuleGroup{Group: g, Folder: folder}
+	}
+
+	seen := make(map[string]bool)
+	for _, instance := range inputs {
+		localGroups, err := readRuleGroups(instance.path(*compareDirectory))
+		if err != nil {
+			return nil, err
+		}
+		for _, localGroup := range localGroups {
+			changeRuleGroupDatasources(localGroup.Group, localGroup.Datasources, clientDS)
+			changeRuleGroupDashboards(localGroup.Group, func(uid string) string {
+				return outputInstance.dashboardUID(instance, uid)
 			})
-			if err != nil {
-				return fmt.Errorf("error comparing dashboards: %w", err)
+			key := ruleGroupKey(localGroup.Folder.Title, localGroup.Group.Title)
+			seen[key] = true
+			outputGroup, ok := outputGroups[key]
+			if !ok {
+				fmt.Printf("Alert rule group %s is new.\n", key)
+				diffs = append(diffs, dashboardDiff{
+					Kind:      kindAlertRuleGroup,
+					Action:    "new",
+					Source:    instance.Name,
+					SourceOrg: instance.orgName(),
+					UID:       key,
+					Title:     localGroup.Group.Title,
+				})
+				continue
+			}
+			if !equalRuleGroups(*localGroup, outputGroup) {
+				fmt.Printf("Alert rule group %s is different.\n", key)
+				diffs = append(diffs, dashboardDiff{
+					Kind:      kindAlertRuleGroup,
+					Action:    "modify",
+					Source:    instance.Name,
+					SourceOrg: instance.orgName(),
+					UID:       key,
+					Title:     localGroup.Group.Title,
+					Diff:      cmp.Diff(localGroup.Group, outputGroup.Group),
+				})
 			}
 		}
 	}
-	data, err := json.MarshalIndent(output, "", " ")
+
+	if !outputInstance.PurgeAlertRules {
+		return diffs, nil
+	}
+	keys := make([]string, 0, len(outputGroups))
+	for key := range outputGroups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		outputGroup := outputGroups[key]
+		fmt.Printf("Alert rule group %s is deleted.\n", key)
+		diffs = append(diffs, dashboardDiff{
+			Kind:   kindAlertRuleGroup,
+			Action: "delete",
+			UID:    key,
+			Title:  outputGroup.Group.Title,
+		})
+	}
+	return diffs, nil
+}
+
+// fetchOutputDashboard fetches a dashboard of an output instance, without the
+// managed tag, with the library panels used by the local dashboard.
+func fetchOutputDashboard(client *gapi.Client, uid string, localDashboard *FullDashboard) (FullDashboard, error) {
+	board, err := client.DashboardByUID(uid)
 	if err != nil {
-		return err
+		return FullDashboard{}, err
 	}
-	err = ioutil.WriteFile(*compareResults, data, 0644)
+	unstampDashboard(board)
+	folder, err := client.Folder(board.Meta.Folder)
 	if err != nil {
-		return err
+		return FullDashboard{}, err
 	}
-	return nil
+
+	libraryPanels := []*gapi.LibraryPanel{}
+	for _, p := range localDashboard.LibraryPanels {
+		panel, err := client.LibraryPanelByUID(p.UID)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return FullDashboard{}, err
+		}
+		libraryPanels = append(libraryPanels, panel)
+	}
+
+	return FullDashboard{Dashboard: board, Folder: folder, LibraryPanels: libraryPanels}, nil
 }
 
 func equalDashboards(a, b FullDashboard) bool {
@@ -180,6 +404,27 @@ func equalDashboards(a, b FullDashboard) bool {
 	if a.Folder.Title != b.Folder.Title {
 		return false
 	}
+	if len(a.LibraryPanels) != len(b.LibraryPanels) {
+		return false
+	}
+	for i := range a.LibraryPanels {
+		if !equalLibraryPanels(a.LibraryPanels[i], b.LibraryPanels[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalLibraryPanels(a, b *gapi.LibraryPanel) bool {
+	if a.UID != b.UID || a.Name != b.Name || a.Description != b.Description {
+		return false
+	}
+	if a.Meta.FolderName != b.Meta.FolderName {
+		return false
+	}
+	if diff := deep.Equal(a.Model, b.Model); diff != nil {
+		return false
+	}
 	return true
 }
 
@@ -0,0 +1,231 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// datasourceConfig overrides the definition of the datasource with the given
+// name when it is provisioned to an output instance. Secrets are read from
+// files and are never fetched.
+type datasourceConfig struct {
+	Name                string            `yaml:"name"`
+	URL                 string            `yaml:"url"`
+	SecureJSONDataFiles map[string]string `yaml:"secure_json_data_files"`
+}
+
+// datasourceDefinitions returns the full definitions of the datasources of an
+// instance. They are kept as raw models so that no jsonData is lost.
+func datasourceDefinitions(api *apiClient) ([]map[string]interface{}, error) {
+	list := []map[string]interface{}{}
+	err := api.request("GET", "/api/datasources", nil, &list)
+	if err != nil {
+		return nil, err
+	}
+	definitions := []map[string]interface{}{}
+	for _, ds := range list {
+		uid, _ := ds["uid"].(string)
+		definition := map[string]interface{}{}
+		err = api.request("GET", "/api/datasources/uid/"+url.PathEscape(uid), nil, &definition)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching datasource %s: %w", uid, err)
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions, nil
+}
+
+// stripDatasource removes the secrets and the instance specific fields of a
+// datasource definition.
+func stripDatasource(ds map[string]interface{}) {
+	for _, k := range []string{"id", "orgId", "version", "readOnly", "typeLogoUrl", "secureJsonFields", "secureJsonData", "password", "basicAuthPassword"} {
+		delete(ds, k)
+	}
+}
+
+func datasourceName(ds map[string]interface{}) string {
+	name, _ := ds["name"].(string)
+	return name
+}
+
+func datasourceType(ds map[string]interface{}) string {
+	t, _ := ds["type"].(string)
+	return t
+}
+
+func fetchDatasourceDefinitions(api *apiClient, basepath string) error {
+	definitions, err := datasourceDefinitions(api)
+	if err != nil {
+		return err
+	}
+	dsPath := filepath.Join(basepath, datasourcesDirectory)
+	err = lazyMkdir(dsPath)
+	if err != nil {
+		return fmt.Errorf("error making directory %s: %w", dsPath, err)
+	}
+	for _, ds := range definitions {
+		uid, _ := ds["uid"].(string)
+		stripDatasource(ds)
+		err = writeJSON(filepath.Join(dsPath, url.PathEscape(uid)+".json"), ds)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDatasourceDefinitions(basepath string) ([]map[string]interface{}, error) {
+	definitions := []map[string]interface{}{}
+	err := readJSONDirectory(filepath.Join(basepath, datasourcesDirectory), func() interface{} {
+		definitions = append(definitions, map[string]interface{}{})
+		return &definitions[len(definitions)-1]
+	})
+	return definitions, err
+}
+
+// applyDatasourceConfig applies the configuration of an output instance to a
+// datasource definition.
+func applyDatasourceConfig(ds map[string]interface{}, cfgs []datasourceConfig) error {
+	for _, c := range cfgs {
+		if c.Name != datasourceName(ds) {
+			continue
+		}
+		if c.URL != "" {
+			ds["url"] = c.URL
+		}
+		if len(c.SecureJSONDataFiles) == 0 {
+			continue
+		}
+		secureJSONData := make(map[string]interface{})
+		for k, f := range c.SecureJSONDataFiles {
+			fileContent, err := ioutil.ReadFile(f)
+			if err != nil {
+				return fmt.Errorf("error reading %s of datasource %s: %w", k, c.Name, err)
+			}
+			secureJSONData[k] = strings.TrimSpace(string(fileContent))
+		}
+		ds["secureJsonData"] = secureJSONData
+	}
+	return nil
+}
+
+// provisionDatasources creates or updates datasources in the output instance
+// from the definitions fetched from the input instance. Datasources are
+// matched by name and type, like when datasources of dashboards are changed.
+func provisionDatasources(cfg *config) error {
+	var inputInstance grafanaInstance
+	var outputInstance grafanaInstance
+	var found bool
+	for _, o := range cfg.Output {
+		if o.Name == *provisionOutput {
+			outputInstance = o
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New("output instance not found")
+	}
+
+	found = false
+	for _, i := range cfg.Input {
+		if i.Name == *provisionSource {
+			inputInstance = i
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return errors.New("input instance not found")
+	}
+
+	inputInstance, err := inputInstance.orgInstance(*provisionSourceOrg)
+	if err != nil {
+		return err
+	}
+	outputInstance, err = outputInstance.outputOrgInstance(*provisionOutputOrg, inputInstance)
+	if err != nil {
+		return err
+	}
+
+	api, err := outputInstance.api()
+	if err != nil {
+		return err
+	}
+
+	definitions, err := readDatasourceDefinitions(inputInstance.path(*provisionDirectory))
+	if err != nil {
+		return err
+	}
+
+	list := []map[string]interface{}{}
+	err = api.request("GET", "/api/datasources", nil, &list)
+	if err != nil {
+		return err
+	}
+
+	for _, ds := range definitions {
+		name := datasourceName(ds)
+		if !shouldProvisionDatasource(name) {
+			continue
+		}
+		err = applyDatasourceConfig(ds, outputInstance.Datasources)
+		if err != nil {
+			return err
+		}
+
+		var existing map[string]interface{}
+		for _, e := range list {
+			if datasourceName(e) == name && datasourceType(e) == datasourceType(ds) {
+				existing = e
+				break
+			}
+		}
+		if existing == nil {
+			fmt.Printf("Creating datasource %s.\n", name)
+			err = api.request("POST", "/api/datasources", ds, nil)
+			if err != nil {
+				return fmt.Errorf("error creating datasource %s: %w", name, err)
+			}
+			continue
+		}
+
+		fmt.Printf("Updating datasource %s.\n", name)
+		ds["uid"] = existing["uid"]
+		id, _ := existing["id"].(float64)
+		err = api.request("PUT", fmt.Sprintf("/api/datasources/%d", int64(id)), ds, nil)
+		if err != nil {
+			return fmt.Errorf("error updating datasource %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func shouldProvisionDatasource(name string) bool {
+	if len(*provisionDatasourcesList) == 0 {
+		return true
+	}
+	for _, n := range *provisionDatasourcesList {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// expansionRegexp matches ${VAR}, ${VAR:-default} and ${file:path}
+// references, and $$, which is an escaped $.
+var (
+	expansionRegexp = regexp.MustCompile(`\$\$|\$\{([^}]*)\}`)
+	envVarRegexp    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// expandConfig expands the references in all the values of a YAML document.
+// Plain values are resolved again after expansion, so that e.g. booleans can
+// come from environment variables, while quoted values remain strings.
+// Encrypted values are decrypted, and never expanded.
+func expandConfig(data []byte, decrypter *ageDecrypter) ([]byte, error) {
+	var doc yamlv3.Node
+	err := yamlv3.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		return data, nil
+	}
+	err = walkConfig(&doc, "", func(n *yamlv3.Node, path string) error {
+		if n.Tag == ageTag {
+			value, err := decrypter.decrypt(n.Value, path)
+			if err != nil {
+				return err
+			}
+			n.Value = value
+			n.Tag = "!!str"
+			n.Style = yamlv3.DoubleQuotedStyle
+			return nil
+		}
+		if n.Tag != "!!str" || !strings.Contains(n.Value, "$") {
+			return nil
+		}
+		value, err := expandString(n.Value, path)
+		if err != nil {
+			return err
+		}
+		n.Value = value
+		if n.Style == 0 {
+			n.Tag = ""
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return yamlv3.Marshal(&doc)
+}
+
+// walkConfig calls f on every scalar of a YAML document, with its path in
+// the document, e.g. grafana_instances_input[0].url.
+func walkConfig(n *yamlv3.Node, path string, f func(*yamlv3.Node, string) error) error {
+	switch n.Kind {
+	case yamlv3.DocumentNode:
+		for _, c := range n.Content {
+			err := walkConfig(c, path, f)
+			if err != nil {
+				return err
+			}
+		}
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			p := n.Content[i].Value
+			if path != "" {
+				p = path + "." + p
+			}
+			err := walkConfig(n.Content[i+1], p, f)
+			if err != nil {
+				return err
+			}
+		}
+	case yamlv3.SequenceNode:
+		for i, c := range n.Content {
+			err := walkConfig(c, path+"["+strconv.Itoa(i)+"]", f)
+			if err != nil {
+				return err
+			}
+		}
+	case yamlv3.ScalarNode:
+		return f(n, path)
+	}
+	return nil
+}
+
+func expandString(s, path string) (string, error) {
+	var err error
+	expanded := expansionRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		if err != nil {
+			return ""
+		}
+		if m == "$$" {
+			return "$"
+		}
+		var value string
+		value, err = expandReference(m[2:len(m)-1], path)
+		return value
+	})
+	return expanded, err
+}
+
+func expandReference(ref, path string) (string, error) {
+	if strings.HasPrefix(ref, "file:") {
+		file := strings.TrimPrefix(ref, "file:")
+		fileContent, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("%s: error reading %s: %w", path, file, err)
+		}
+		return strings.TrimSpace(string(fileContent)), nil
+	}
+
+	name, def, hasDefault := ref, "", false
+	if i := strings.Index(ref, ":-"); i >= 0 {
+		name, def, hasDefault = ref[:i], ref[i+2:], true
+	}
+	if !envVarRegexp.MatchString(name) {
+		return "", fmt.Errorf("%s: invalid reference ${%s}", path, ref)
+	}
+	// Like in shells, the default also replaces empty values.
+	if value, ok := os.LookupEnv(name); ok && (value != "" || !hasDefault) {
+		return value, nil
+	}
+	if hasDefault {
+		return def, nil
+	}
+	return "", fmt.Errorf("%s: environment variable %s is not set", path, name)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigExpansion(t *testing.T) {
+	dir := t.TempDir()
+
+	secret := filepath.Join(dir, "secret")
+	require.NoError(t, ioutil.WriteFile(secret, []byte("0123\n"), 0600))
+	os.Setenv("DM_TEST_URL", "https://grafana.example.com")
+	os.Setenv("DM_TEST_PURGE", "true")
+	os.Setenv("DM_TEST_TAG", "")
+	defer os.Unsetenv("DM_TEST_URL")
+	defer os.Unsetenv("DM_TEST_PURGE")
+	defer os.Unsetenv("DM_TEST_TAG")
+
+	configFile := filepath.Join(dir, "config.yml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(`
+grafana_instances_output:
+  - name: prod
+    url: ${DM_TEST_URL}/grafana
+    api_key: ${file:`+secret+`}
+    purge_dashboards: ${DM_TEST_PURGE}
+    include_tags: ["${DM_TEST_TAG:-prod}", "team${DM_TEST_TAG}", "$${literal}"]
+`), 0600))
+	cfg, err := loadConfig(configFile)
+	require.NoError(t, err)
+	require.Equal(t, "https://grafana.example.com/grafana", cfg.Output[0].URL)
+	require.Equal(t, "0123", cfg.Output[0].Auth)
+	require.True(t, cfg.Output[0].PurgeDashboards)
+	require.Equal(t, []string{"prod", "team", "${literal}"}, cfg.Output[0].IncludeTags)
+
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(`
+grafana_instances_output:
+  - name: prod
+    url: ${DM_TEST_UNSET}
+`), 0600))
+	_, err = loadConfig(configFile)
+	require.EqualError(t, err, "grafana_instances_output[0].url: environment variable DM_TEST_UNSET is not set")
+}
+
+func TestLoadConfigDecryption(t *testing.T) {
+	dir := t.TempDir()
+
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	identityFile := filepath.Join(dir, "identity")
+	require.NoError(t, ioutil.WriteFile(identityFile, []byte(id.String()+"\n"), 0600))
+
+	buf := &bytes.Buffer{}
+	a := armor.NewWriter(buf)
+	w, err := age.Encrypt(a, id.Recipient())
+	require.NoError(t, err)
+	_, err = w.Write([]byte("secret-key"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, a.Close())
+
+	configFile := filepath.Join(dir, "config.yml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(`
+grafana_instances_input:
+  - name: dev
+    api_key: !age |
+      `+strings.ReplaceAll(strings.TrimSpace(buf.String()), "\n", "\n      ")+`
+`), 0600))
+
+	*identity = ""
+	_, err = loadConfig(configFile)
+	require.EqualError(t, err, "grafana_instances_input[0].api_key: value is encrypted but no age identity file is set")
+
+	*identity = identityFile
+	defer func() { *identity = "" }()
+	cfg, err := loadConfig(configFile)
+	require.NoError(t, err)
+	require.Equal(t, "secret-key", cfg.Input[0].Auth)
+}
@@ -15,9 +15,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	gapi "github.com/grafana/grafana-api-golang-client"
 )
@@ -30,10 +32,58 @@ func lazyMkdir(path string) error {
 	return err
 }
 
+// Resources that are not dashboards are stored in directories whose name
+// starts with a dot. Grafana UIDs can not contain dots, so those directories
+// can not clash with the folder directories.
+const (
+	alertingDirectory    = ".alerting"
+	datasourcesDirectory = ".datasources"
+)
+
 type FullDashboard struct {
-	Dashboard   *gapi.Dashboard `json:"board"`
-	Datasources []*gapi.DataSource
-	Folder      *gapi.Folder
+	Dashboard     *gapi.Dashboard `json:"board"`
+	Datasources   []*gapi.DataSource
+	Folder        *gapi.Folder
+	LibraryPanels []*gapi.LibraryPanel `json:",omitempty"`
+
+	// path is the file the dashboard was read from.
+	path string
+	// template is the UID of the dashboard it was generated from, if any.
+	template string
+}
+
+// prepareDashboard applies the changes of a dashboard of an input instance
+// specific to an output instance: its overlays, its template values, the
+// rewriting of its links, then the mapping of its UID.
+func (g *grafanaInstance) prepareDashboard(input grafanaInstance, d *FullDashboard) error {
+	err := g.applyOverlays(d)
+	if err != nil {
+		return err
+	}
+	err = g.renderDashboard(d)
+	if err != nil {
+		return err
+	}
+	newLinkRewriter(input, *g, func(uid string) string {
+		// Links to dashboards which only exist in the output instance
+		// keep their UID.
+		if !input.dashboardUIDs[uid] {
+			return uid
+		}
+		return g.dashboardUID(input, uid)
+	}).rewriteDashboard(d)
+
+	uid, err := getUID(d.Dashboard)
+	if err != nil {
+		return err
+	}
+	mapped := g.dashboardUID(input, uid)
+	err = validateUID(mapped)
+	if err != nil {
+		return fmt.Errorf("dashboard %s in %s: %w", uid, instanceKey(*g), err)
+	}
+	d.Dashboard.Model["uid"] = mapped
+	return nil
 }
 
 func fetchDashboards(cfg *config) error {
@@ -43,79 +93,217 @@ func fetchDashboards(cfg *config) error {
 	}
 
 	for _, instance := range cfg.Input {
-		client, err := instance.client()
+		// Dashboards of jsonnet instances are evaluated when they are used.
+		if instance.Jsonnet != nil {
+			continue
+		}
+		err = lazyMkdir(filepath.Join(*fetchDirectory, instance.Name))
+		if err != nil {
+			return fmt.Errorf("error making directory for %s: %w", instance.Name, err)
+		}
+		orgInstances, err := instance.orgInstances()
 		if err != nil {
 			return err
 		}
-		basepath := filepath.Join(*fetchDirectory, instance.Name)
-		err = lazyMkdir(basepath)
+		for _, orgInstance := range orgInstances {
+			err = fetchInstance(orgInstance)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fetchInstance fetches the resources of an input instance, or of one of its
+// organizations.
+func fetchInstance(instance grafanaInstance) error {
+	client, err := instance.client()
+	if err != nil {
+		return err
+	}
+	basepath := instance.path(*fetchDirectory)
+	err = lazyMkdir(basepath)
+	if err != nil {
+		return fmt.Errorf("error making directory for %s: %w", instance.Name, err)
+	}
+
+	dashboards, err := client.Dashboards()
+	if err != nil {
+		return err
+	}
+
+	clientDS := clientDatasources(client)
+
+	for _, d := range dashboards {
+		board, err := client.DashboardByUID(d.UID)
 		if err != nil {
-			return fmt.Errorf("error making directory for %s: %w", instance.Name, err)
+			return fmt.Errorf("error fetching %s: %w", d.UID, err)
 		}
 
-		dashboards, err := client.Dashboards()
+		if !instance.shouldIncludeDashboard(board) {
+			continue
+		}
+
+		dashboard, err := fullDashboard(client, clientDS, board)
 		if err != nil {
 			return err
 		}
 
-		clientDS := []*gapi.DataSource{}
-		// Hard code limit to 50 for now.
-		for i := int64(0); i < 50; i++ {
-			ds, err := client.DataSource(i)
-			if err == nil {
-				clientDS = append(clientDS, ds)
-			}
+		err = writeDashboard(basepath, dashboard)
+		if err != nil {
+			return err
 		}
+	}
 
-		for _, d := range dashboards {
-			board, err := client.DashboardByUID(d.UID)
-			if err != nil {
-				return fmt.Errorf("error fetching %s: %w", d.UID, err)
-			}
+	api, err := instance.api()
+	if err != nil {
+		return err
+	}
+	err = fetchRuleGroups(client, api, basepath, clientDS)
+	if err != nil {
+		return fmt.Errorf("error fetching alert rules of %s: %w", instance.Name, err)
+	}
+	err = fetchNotifications(api, basepath)
+	if err != nil {
+		return fmt.Errorf("error fetching notifications of %s: %w", instance.Name, err)
+	}
+	err = fetchDatasourceDefinitions(api, basepath)
+	if err != nil {
+		return fmt.Errorf("error fetching datasources of %s: %w", instance.Name, err)
+	}
+	return nil
+}
 
-			if !instance.shouldIncludeDashboard(board) {
-				continue
-			}
+// fullDashboard fetches the folder of a dashboard, the library panels it uses
+// and its datasources.
+func fullDashboard(client *gapi.Client, clientDS []*gapi.DataSource, board *gapi.Dashboard) (*FullDashboard, error) {
+	folder, err := client.Folder(board.Meta.Folder)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching folder %d: %w", board.Meta.Folder, err)
+	}
 
-			folder, err := client.Folder(board.Meta.Folder)
-			if err != nil {
-				return fmt.Errorf("error fetching folder %d: %w", board.Meta.Folder, err)
-			}
+	libraryPanels := []*gapi.LibraryPanel{}
+	for _, uid := range getLibraryPanels(board) {
+		panel, err := client.LibraryPanelByUID(uid)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching library panel %s: %w", uid, err)
+		}
+		libraryPanels = append(libraryPanels, panel)
+	}
 
-			dashboardDS := []*gapi.DataSource{}
-			datasources := getDatasources(board)
-			for _, ds := range clientDS {
-				for _, v := range datasources {
-					if ds.UID == v {
-						dashboardDS = append(dashboardDS, &gapi.DataSource{
-							UID:  ds.UID,
-							Type: ds.Type,
-							Name: ds.Name,
-						})
-					}
-				}
-			}
+	return &FullDashboard{
+		Dashboard:     board,
+		Folder:        folder,
+		Datasources:   dashboardDatasources(clientDS, getAllDatasources(board, libraryPanels)),
+		LibraryPanels: libraryPanels,
+	}, nil
+}
 
-			data, err := json.MarshalIndent(FullDashboard{
-				Dashboard:   board,
-				Folder:      folder,
-				Datasources: dashboardDS,
-			}, "", " ")
-			if err != nil {
-				return err
+// dashboardDatasources returns the datasources of the instance with the given
+// UIDs.
+func dashboardDatasources(clientDS []*gapi.DataSource, uids []string) []*gapi.DataSource {
+	dashboardDS := []*gapi.DataSource{}
+	for _, ds := range clientDS {
+		for _, v := range uids {
+			if ds.UID == v {
+				dashboardDS = append(dashboardDS, &gapi.DataSource{
+					UID:  ds.UID,
+					Type: ds.Type,
+					Name: ds.Name,
+				})
 			}
+		}
+	}
+	return dashboardDS
+}
 
-			folderPath := filepath.Join(basepath, folder.UID)
-			err = lazyMkdir(folderPath)
-			if err != nil {
-				return fmt.Errorf("error making directory for %s / %s: %w", instance.Name, d.FolderUID, err)
-			}
+// writeDashboard writes a dashboard in the directory of its folder.
+func writeDashboard(basepath string, dashboard *FullDashboard) error {
+	uid, err := getUID(dashboard.Dashboard)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(dashboard, "", " ")
+	if err != nil {
+		return err
+	}
 
-			filePath := filepath.Join(folderPath, d.UID+".json")
-			err = ioutil.WriteFile(filePath, data, 0644)
-			if err != nil {
-				return err
+	folderPath := filepath.Join(basepath, dashboard.Folder.UID)
+	err = lazyMkdir(folderPath)
+	if err != nil {
+		return fmt.Errorf("error making directory for %s / %s: %w", basepath, dashboard.Folder.UID, err)
+	}
+
+	return ioutil.WriteFile(filepath.Join(folderPath, uid+".json"), data, 0644)
+}
+
+// readDashboards reads all the dashboards stored under basepath, skipping the
+// directories of the other resources.
+func readDashboards(basepath string) ([]*FullDashboard, error) {
+	dashboards := []*FullDashboard{}
+	err := filepath.Walk(basepath, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != basepath && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
 			}
+			return nil
+		}
+		// Overlays are next to the dashboards they apply to.
+		if strings.HasSuffix(info.Name(), patchSuffix) || strings.HasSuffix(info.Name(), mergeSuffix) {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		localDashboard := &FullDashboard{path: path}
+		err = json.Unmarshal(data, localDashboard)
+		if err != nil {
+			return err
+		}
+		dashboards = append(dashboards, localDashboard)
+		return nil
+	})
+	return dashboards, err
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// readJSONDirectory reads all the files of a directory with newItem, which
+// returns a pointer to a new item. Missing directories are ignored.
+func readJSONDirectory(path string, newItem func() interface{}) error {
+	files, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		err = readJSON(filepath.Join(path, f.Name()), newItem())
+		if err != nil {
+			return err
 		}
 	}
 	return nil
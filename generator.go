@@ -0,0 +1,278 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// generatorConfig fans out a template dashboard of an input instance into a
+// dashboard per set of parameters. The UID, title, tags and variables are
+// rendered with the parameters, like the placeholders of the template.
+type generatorConfig struct {
+	Dashboard      string                   `yaml:"dashboard"`
+	UID            string                   `yaml:"uid"`
+	Title          string                   `yaml:"title"`
+	Tags           []string                 `yaml:"tags"`
+	Variables      map[string]string        `yaml:"variables"`
+	Parameters     []map[string]interface{} `yaml:"parameters"`
+	ParametersFile string                   `yaml:"parameters_file"`
+}
+
+// dashboards returns the dashboards of the instance in a directory, or
+// evaluated from jsonnet, with the dashboards of its generators instead of
+// their templates. Their UIDs are kept to rewrite the links between them.
+func (g *grafanaInstance) dashboards(directory string) ([]*FullDashboard, error) {
+	var dashboards []*FullDashboard
+	var err error
+	if g.Jsonnet != nil {
+		dashboards, err = g.Jsonnet.jsonnetDashboards()
+	} else {
+		dashboards, err = readDashboards(g.path(directory))
+	}
+	if err != nil {
+		return nil, err
+	}
+	dashboards, err = g.generateDashboards(dashboards)
+	if err != nil {
+		return nil, err
+	}
+	g.dashboardUIDs = make(map[string]bool, len(dashboards))
+	for _, d := range dashboards {
+		uid, err := getUID(d.Dashboard)
+		if err != nil {
+			return nil, err
+		}
+		g.dashboardUIDs[uid] = true
+	}
+	return dashboards, nil
+}
+
+func (g *grafanaInstance) generateDashboards(dashboards []*FullDashboard) ([]*FullDashboard, error) {
+	if len(g.Generators) == 0 {
+		return dashboards, nil
+	}
+	templates := make(map[string]*generatorConfig)
+	for i := range g.Generators {
+		templates[g.Generators[i].Dashboard] = &g.Generators[i]
+	}
+
+	uids := make(map[string]bool)
+	output := []*FullDashboard{}
+	generated := []*FullDashboard{}
+	for _, d := range dashboards {
+		uid, err := getUID(d.Dashboard)
+		if err != nil {
+			return nil, err
+		}
+		gen, ok := templates[uid]
+		if !ok {
+			uids[uid] = true
+			output = append(output, d)
+			continue
+		}
+		delete(templates, uid)
+		dashboards, err := gen.generate(d)
+		if err != nil {
+			return nil, fmt.Errorf("generator of %s: %w", uid, err)
+		}
+		generated = append(generated, dashboards...)
+	}
+	for _, gen := range g.Generators {
+		if _, ok := templates[gen.Dashboard]; ok {
+			return nil, fmt.Errorf("generator of %s: dashboard not found", gen.Dashboard)
+		}
+	}
+
+	for _, d := range generated {
+		uid, _ := getUID(d.Dashboard)
+		if uids[uid] {
+			return nil, fmt.Errorf("generated dashboard %s already exists", uid)
+		}
+		uids[uid] = true
+	}
+	return append(output, generated...), nil
+}
+
+// generate renders the template dashboard with each set of parameters.
+func (gen *generatorConfig) generate(template *FullDashboard) ([]*FullDashboard, error) {
+	parameters, err := gen.parameters()
+	if err != nil {
+		return nil, err
+	}
+	dashboards := make([]*FullDashboard, 0, len(parameters))
+	for _, params := range parameters {
+		d, err := cloneDashboard(template)
+		if err != nil {
+			return nil, err
+		}
+		// Library panels are shared by the generated dashboards, so they are
+		// not rendered with the parameters.
+		d.Dashboard.Model = renderValue(d.Dashboard.Model, params, nil).(map[string]interface{})
+
+		uid, err := renderParameters(gen.UID, params)
+		if err != nil {
+			return nil, fmt.Errorf("uid: %w", err)
+		}
+		err = validateUID(uid)
+		if err != nil {
+			return nil, err
+		}
+		d.Dashboard.Model["uid"] = uid
+		d.path = filepath.Join(filepath.Dir(template.path), uid+".json")
+		d.template, _ = getUID(template.Dashboard)
+		delete(d.Dashboard.Model, "id")
+
+		if gen.Title != "" {
+			title, err := renderParameters(gen.Title, params)
+			if err != nil {
+				return nil, fmt.Errorf("title: %w", err)
+			}
+			d.Dashboard.Model["title"] = title
+		}
+
+		tags := []interface{}{}
+		for _, t := range getTags(d.Dashboard) {
+			tags = append(tags, t)
+		}
+		for _, t := range gen.Tags {
+			tag, err := renderParameters(t, params)
+			if err != nil {
+				return nil, fmt.Errorf("tag %s: %w", t, err)
+			}
+			tags = append(tags, tag)
+		}
+		d.Dashboard.Model["tags"] = tags
+
+		for name, v := range gen.Variables {
+			value, err := renderParameters(v, params)
+			if err != nil {
+				return nil, fmt.Errorf("variable %s: %w", name, err)
+			}
+			err = setVariableDefault(d.Dashboard.Model, name, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		dashboards = append(dashboards, d)
+	}
+	return dashboards, nil
+}
+
+// renderParameters renders a string of a generator, in which all the
+// placeholders must be parameters.
+func renderParameters(s string, params map[string]interface{}) (string, error) {
+	missing := make(map[string]bool)
+	out := fmt.Sprint(renderString(s, params, missing))
+	if len(missing) > 0 {
+		return "", fmt.Errorf("parameters %s are not defined", missingNames(missing))
+	}
+	return out, nil
+}
+
+// setVariableDefault sets the current value of a variable of a dashboard.
+func setVariableDefault(model map[string]interface{}, name, value string) error {
+	for _, v := range dashboardVariables(model) {
+		variable, ok := v.(map[string]interface{})
+		if !ok || variable["name"] != name {
+			continue
+		}
+		variable["current"] = map[string]interface{}{
+			"selected": true,
+			"text":     value,
+			"value":    value,
+		}
+		switch variable["type"] {
+		case "textbox", "constant":
+			variable["query"] = value
+		}
+		options, _ := variable["options"].([]interface{})
+		for _, o := range options {
+			if option, ok := o.(map[string]interface{}); ok {
+				option["selected"] = option["value"] == value
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("variable %s not found", name)
+}
+
+// parameters returns the sets of parameters of the generator, from its
+// configuration and its parameters file.
+func (gen *generatorConfig) parameters() ([]map[string]interface{}, error) {
+	parameters := append([]map[string]interface{}{}, gen.Parameters...)
+	if gen.ParametersFile == "" {
+		return parameters, nil
+	}
+	data, err := ioutil.ReadFile(gen.ParametersFile)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Ext(gen.ParametersFile) {
+	case ".csv":
+		records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", gen.ParametersFile, err)
+		}
+		if len(records) == 0 {
+			return parameters, nil
+		}
+		for _, r := range records[1:] {
+			params := make(map[string]interface{})
+			for i, name := range records[0] {
+				params[name] = r[i]
+			}
+			parameters = append(parameters, params)
+		}
+	case ".yml", ".yaml":
+		var list []map[string]interface{}
+		err = yamlv3.Unmarshal(data, &list)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", gen.ParametersFile, err)
+		}
+		parameters = append(parameters, list...)
+	default:
+		return nil, fmt.Errorf("parameters file %s is neither CSV nor YAML", gen.ParametersFile)
+	}
+	return parameters, nil
+}
+
+// resolveGeneratorPaths makes the parameters files of the generators of the
+// instance relative to the directory of the config file.
+func (g *grafanaInstance) resolveGeneratorPaths(dir string) {
+	for i := range g.Generators {
+		if f := g.Generators[i].ParametersFile; f != "" && !filepath.IsAbs(f) {
+			g.Generators[i].ParametersFile = filepath.Join(dir, f)
+		}
+	}
+}
+
+// validateGenerators checks that the generators of the instance have a
+// template dashboard and a UID depending on the parameters.
+func (g *grafanaInstance) validateGenerators() error {
+	for _, gen := range g.Generators {
+		if gen.Dashboard == "" {
+			return fmt.Errorf("instance %s: generator without dashboard", g.Name)
+		}
+		if !templateRegexp.MatchString(gen.UID) {
+			return fmt.Errorf("instance %s: generator of %s: uid must contain parameters", g.Name, gen.Dashboard)
+		}
+	}
+	return nil
+}
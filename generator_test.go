@@ -0,0 +1,100 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateDashboards(t *testing.T) {
+	dir := t.TempDir()
+	parameters := filepath.Join(dir, "services.csv")
+	require.NoError(t, ioutil.WriteFile(parameters, []byte("service,team\nweb,frontend\n"), 0644))
+
+	input := grafanaInstance{Name: "dev", Generators: []generatorConfig{{
+		Dashboard:      "service",
+		UID:            "service-%{service}",
+		Title:          "%{service} overview",
+		Tags:           []string{"team:%{team}"},
+		Variables:      map[string]string{"service": "%{service}"},
+		Parameters:     []map[string]interface{}{{"service": "api", "team": "backend"}},
+		ParametersFile: parameters,
+	}}}
+	dashboards, err := input.generateDashboards([]*FullDashboard{
+		{Dashboard: &gapi.Dashboard{Model: mustModel(t, `{"uid": "nodes"}`)}},
+		{path: filepath.Join(dir, "general", "service.json"), Dashboard: &gapi.Dashboard{Model: mustModel(t, `{
+			"id": 3,
+			"uid": "service",
+			"title": "Service",
+			"tags": ["services"],
+			"panels": [{"targets": [{"expr": "up{job=\"%{service}\",cluster=\"%{cluster}\"}"}]}],
+			"templating": {"list": [{"name": "service", "type": "textbox", "query": ""}]}
+		}`)}, LibraryPanels: []*gapi.LibraryPanel{{UID: "requests", Model: mustModel(t, `{"title": "%{service} requests"}`)}}},
+	})
+	require.NoError(t, err)
+	require.Len(t, dashboards, 3)
+
+	require.Equal(t, mustModel(t, `{"uid": "nodes"}`), dashboards[0].Dashboard.Model)
+	require.Equal(t, filepath.Join(dir, "general", "service-api.json"), dashboards[1].path)
+	require.Equal(t, "service", dashboards[1].template)
+	require.Equal(t, mustModel(t, `{"title": "%{service} requests"}`), dashboards[1].LibraryPanels[0].Model)
+	require.Equal(t, mustModel(t, `{
+		"uid": "service-api",
+		"title": "api overview",
+		"tags": ["services", "team:backend"],
+		"panels": [{"targets": [{"expr": "up{job=\"api\",cluster=\"%{cluster}\"}"}]}],
+		"templating": {"list": [{
+			"name": "service",
+			"type": "textbox",
+			"query": "api",
+			"current": {"selected": true, "text": "api", "value": "api"}
+		}]}
+	}`), mustRoundTrip(t, dashboards[1].Dashboard.Model))
+	uid, err := getUID(dashboards[2].Dashboard)
+	require.NoError(t, err)
+	require.Equal(t, "service-web", uid)
+
+	input.Generators[0].Variables = nil
+	input.Generators[0].Parameters = append(input.Generators[0].Parameters, map[string]interface{}{"service": "web", "team": "frontend"})
+	_, err = input.generateDashboards([]*FullDashboard{
+		{Dashboard: &gapi.Dashboard{Model: mustModel(t, `{"uid": "service"}`)}},
+	})
+	require.EqualError(t, err, "generated dashboard service-web already exists")
+}
+
+func TestBackportGeneratedDashboard(t *testing.T) {
+	dir := t.TempDir()
+	input := grafanaInstance{Name: "dev", Generators: []generatorConfig{{
+		Dashboard:      "service",
+		UID:            "service-%{service}",
+		ParametersFile: "services.yml",
+	}}}
+	input.resolveGeneratorPaths(dir)
+	require.Equal(t, filepath.Join(dir, "services.yml"), input.Generators[0].ParametersFile)
+	require.NoError(t, ioutil.WriteFile(input.Generators[0].ParametersFile, []byte("- service: api\n- service: web\n"), 0644))
+	for _, uid := range []string{"service", "nodes"} {
+		mustWriteDashboard(t, dir, "dev", map[string]interface{}{"uid": uid})
+	}
+
+	output := grafanaInstance{Name: "prod"}
+	_, err := inputDashboardUIDs(input, output, dir, []string{"service-web"})
+	require.EqualError(t, err, "dashboard service-web is generated from service and can not be backported")
+	uids, err := inputDashboardUIDs(input, output, dir, []string{"nodes"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"nodes": "nodes", "service-api": "service-api", "service-web": "service-web"}, uids)
+}
@@ -3,13 +3,15 @@ module github.com/inuits/dashboard-manager
 go 1.16
 
 require (
+	filippo.io/age v1.0.0
 	github.com/alecthomas/units v0.0.0-20210208195552-ff826a37aa15 // indirect
 	github.com/go-test/deep v1.0.7
 	github.com/google/go-cmp v0.5.5
+	github.com/google/go-jsonnet v0.17.0
 	github.com/grafana/grafana-api-golang-client v0.3.0
 	github.com/prometheus/common v0.31.1
-	github.com/stretchr/testify v1.7.0 // indirect
-	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
+	github.com/stretchr/testify v1.7.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
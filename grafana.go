@@ -14,7 +14,6 @@ package main
 
 import (
 	"errors"
-	"io/ioutil"
 	"reflect"
 	"strings"
 
@@ -23,39 +22,89 @@ import (
 )
 
 type grafanaInstance struct {
-	Name            string                   `yaml:"name"`
-	URL             string                   `yaml:"url"`
-	Auth            string                   `yaml:"api_key"`
-	AuthFile        string                   `yaml:"api_key_file"`
-	IncludeTags     []string                 `yaml:"include_tags"`
-	PurgeDashboards bool                     `yaml:"purge_dashboards"`
-	HttpClient      promcfg.HTTPClientConfig `yaml:"http_client"`
+	Name                    string                   `yaml:"name"`
+	URL                     string                   `yaml:"url"`
+	Auth                    string                   `yaml:"api_key"`
+	AuthFile                string                   `yaml:"api_key_file"`
+	ServiceAccountToken     string                   `yaml:"service_account_token"`
+	ServiceAccountTokenFile string                   `yaml:"service_account_token_file"`
+	BasicAuth               *basicAuthConfig         `yaml:"basic_auth"`
+	Exec                    *execAuthConfig          `yaml:"exec"`
+	IncludeTags             []string                 `yaml:"include_tags"`
+	PurgeDashboards         bool                     `yaml:"purge_dashboards"`
+	PurgeAlertRules         bool                     `yaml:"purge_alert_rules"`
+	ReadOnly                bool                     `yaml:"read_only"`
+	Provenance              bool                     `yaml:"provenance"`
+	Annotations             *annotationConfig        `yaml:"annotations"`
+	TemplateValues          map[string]interface{}   `yaml:"template_values"`
+	UIDMappings             []uidMappingConfig       `yaml:"uid_mappings"`
+	InputPrecedence         []string                 `yaml:"input_precedence"`
+	DashboardOwners         map[string]string        `yaml:"dashboard_owners"`
+	Generators              []generatorConfig        `yaml:"generators"`
+	Jsonnet                 *jsonnetConfig           `yaml:"jsonnet"`
+	HttpClient              promcfg.HTTPClientConfig `yaml:"http_client"`
+	ContactPoints           []contactPointConfig     `yaml:"contact_points"`
+	Receivers               map[string]string        `yaml:"receivers"`
+	Datasources             []datasourceConfig       `yaml:"datasources"`
+	Orgs                    []orgConfig              `yaml:"orgs"`
+	InputOrg                string                   `yaml:"input_org"`
+
+	// org is the organization this copy of the instance is restricted to.
+	org *orgConfig
+	// dashboardUIDs are the UIDs of the dashboards of an input instance,
+	// once they are read.
+	dashboardUIDs map[string]bool
+}
+
+func (g *grafanaInstance) clientConfig() (gapi.Config, error) {
+	client, err := promcfg.NewClientFromConfig(g.HttpClient, "grafana")
+	if err != nil {
+		return gapi.Config{}, err
+	}
+	cfg := gapi.Config{
+		Client: client,
+	}
+	if g.org != nil {
+		cfg.OrgID = g.org.ID
+	}
+	err = g.setAuth(&cfg)
+	return cfg, err
 }
 
 func (g *grafanaInstance) client() (*gapi.Client, error) {
-	auth := g.Auth
-	if g.AuthFile != "" {
-		fileContent, err := ioutil.ReadFile(g.AuthFile)
-		if err != nil {
-			return nil, err
-		}
-		auth = strings.TrimSpace(string(fileContent))
+	cfg, err := g.clientConfig()
+	if err != nil {
+		return nil, err
 	}
-	client, err := promcfg.NewClientFromConfig(g.HttpClient, "grafana")
+	return gapi.New(g.URL, cfg)
+}
+
+func (g *grafanaInstance) api() (*apiClient, error) {
+	cfg, err := g.clientConfig()
 	if err != nil {
 		return nil, err
 	}
-	return gapi.New(g.URL, gapi.Config{
-		APIKey: auth,
-		Client: client,
-	})
+	return newAPIClient(g.URL, cfg)
+}
+
+// clientDatasources returns the datasources of an instance.
+func clientDatasources(client *gapi.Client) []*gapi.DataSource {
+	clientDS := []*gapi.DataSource{}
+	// Hard code limit to 50 for now.
+	for i := int64(0); i < 50; i++ {
+		ds, err := client.DataSource(i)
+		if err == nil {
+			clientDS = append(clientDS, ds)
+		}
+	}
+	return clientDS
 }
 
 func (g *grafanaInstance) shouldIncludeDashboard(b *gapi.Dashboard) bool {
 	if len(g.IncludeTags) == 0 {
 		return true
 	}
-	for _, t := range b.Model["tags"].([]string) {
+	for _, t := range getTags(b) {
 		lt := strings.ToLower(t)
 		for _, i := range g.IncludeTags {
 			if strings.ToLower(i) == lt {
@@ -67,8 +116,18 @@ func (g *grafanaInstance) shouldIncludeDashboard(b *gapi.Dashboard) bool {
 }
 
 func getTags(b *gapi.Dashboard) []string {
-	if tags, ok := b.Model["tags"].([]string); ok {
+	switch tags := b.Model["tags"].(type) {
+	case []string:
 		return tags
+	case []interface{}:
+		// Dashboards read from JSON files.
+		var output []string
+		for _, t := range tags {
+			if s, ok := t.(string); ok {
+				output = append(output, s)
+			}
+		}
+		return output
 	}
 	return nil
 }
@@ -158,11 +217,62 @@ func changeDS(v reflect.Value, equiv map[string]string) {
 	}
 }
 
+func extractLibraryPanels(v reflect.Value) []string {
+	var output []string
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Array, reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			output = append(output, extractLibraryPanels(v.Index(i))...)
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			innerVal := v.MapIndex(k)
+			output = append(output, extractLibraryPanels(innerVal)...)
+			if k.String() == "libraryPanel" && innerVal.Kind() == reflect.Interface {
+				innerInt := innerVal.Interface()
+				if v, ok := innerInt.(map[string]interface{}); ok {
+					if uid, ok := v["uid"].(string); ok && uid != "" {
+						output = append(output, uid)
+					}
+				}
+			}
+		}
+	default:
+	}
+
+	keys := make(map[string]bool)
+	var list []string
+	for _, item := range output {
+		if _, value := keys[item]; !value {
+			list = append(list, item)
+			keys[item] = true
+		}
+	}
+	return list
+}
+
 func getDatasources(b *gapi.Dashboard) []string {
 	return extractDS(reflect.ValueOf(b.Model))
 }
 
-func changeDatasources(b *gapi.Dashboard, in, out []*gapi.DataSource) {
+// getAllDatasources returns the datasources used by a dashboard and by the
+// library panels it references.
+func getAllDatasources(b *gapi.Dashboard, panels []*gapi.LibraryPanel) []string {
+	models := []interface{}{b.Model}
+	for _, p := range panels {
+		models = append(models, p.Model)
+	}
+	return extractDS(reflect.ValueOf(models))
+}
+
+func getLibraryPanels(b *gapi.Dashboard) []string {
+	return extractLibraryPanels(reflect.ValueOf(b.Model))
+}
+
+func datasourcesEquivalence(in, out []*gapi.DataSource) map[string]string {
 	equiv := make(map[string]string)
 	for _, inv := range in {
 		for _, outv := range out {
@@ -171,6 +281,31 @@ func changeDatasources(b *gapi.Dashboard, in, out []*gapi.DataSource) {
 			}
 		}
 	}
+	return equiv
+}
+
+func changeDatasources(b *gapi.Dashboard, in, out []*gapi.DataSource) {
+	changeDS(reflect.ValueOf(b.Model), datasourcesEquivalence(in, out))
+}
+
+func changeLibraryPanelDatasources(p *gapi.LibraryPanel, in, out []*gapi.DataSource) {
+	changeDS(reflect.ValueOf(p.Model), datasourcesEquivalence(in, out))
+}
+
+// isNotFound returns true if the error returned by the Grafana client is a
+// 404.
+func isNotFound(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "status: 404")
+}
+
+// isUnauthorized returns true if the error returned by the Grafana client is
+// a 401.
+func isUnauthorized(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "status: 401")
+}
 
-	changeDS(reflect.ValueOf(b.Model), equiv)
+// isForbidden returns true if the error returned by the Grafana client is a
+// 403.
+func isForbidden(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "status: 403")
 }
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"testing"
 
+	gapi "github.com/grafana/grafana-api-golang-client"
 	"github.com/stretchr/testify/require"
 )
 
@@ -25,3 +26,16 @@ func TestChangeDataSource(t *testing.T) {
 	require.Len(t, localDashboard.Datasources, 1)
 	require.Equal(t, localDashboard.Dashboard, expectedDashboard.Dashboard)
 }
+
+func TestGetLibraryPanels(t *testing.T) {
+	board := &gapi.Dashboard{}
+	err := json.Unmarshal([]byte(`{"dashboard": {"panels": [
+		{"id": 1, "libraryPanel": {"uid": "lib1", "name": "Library panel 1"}},
+		{"id": 2, "type": "row", "panels": [
+			{"id": 3, "libraryPanel": {"uid": "lib2", "name": "Library panel 2"}},
+			{"id": 4, "libraryPanel": {"uid": "lib1", "name": "Library panel 1"}}
+		]}
+	]}}`), board)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"lib1", "lib2"}, getLibraryPanels(board))
+}
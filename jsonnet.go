@@ -0,0 +1,190 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-jsonnet"
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// jsonnetConfig makes an input instance evaluate the .jsonnet files of a
+// directory, e.g. written with grafonnet, instead of fetching dashboards from
+// Grafana.
+type jsonnetConfig struct {
+	Directory string            `yaml:"directory"`
+	LibPaths  []string          `yaml:"lib_paths"`
+	ExtVars   map[string]string `yaml:"ext_vars"`
+
+	// evaluated caches the dashboards, which are evaluated once per run.
+	evaluated []*FullDashboard
+}
+
+// jsonnetDashboards returns the dashboards evaluated from the .jsonnet files
+// of the directory. They are copies, as they are changed for every output
+// instance.
+func (cfg *jsonnetConfig) jsonnetDashboards() ([]*FullDashboard, error) {
+	if cfg.evaluated == nil {
+		evaluated, err := cfg.evaluate()
+		if err != nil {
+			return nil, err
+		}
+		cfg.evaluated = evaluated
+	}
+	dashboards := make([]*FullDashboard, 0, len(cfg.evaluated))
+	for _, d := range cfg.evaluated {
+		clone, err := cloneDashboard(d)
+		if err != nil {
+			return nil, err
+		}
+		dashboards = append(dashboards, clone)
+	}
+	return dashboards, nil
+}
+
+// evaluate evaluates the .jsonnet files of the directory. A file evaluates to
+// a dashboard, a list of dashboards or an object of dashboards. Dashboards in
+// subdirectories are in the folder named after the subdirectory.
+func (cfg *jsonnetConfig) evaluate() ([]*FullDashboard, error) {
+	vm := jsonnet.MakeVM()
+	vm.Importer(&jsonnet.FileImporter{JPaths: cfg.LibPaths})
+	for k, v := range cfg.ExtVars {
+		vm.ExtVar(k, v)
+	}
+
+	libs := make(map[string]bool)
+	for _, p := range cfg.LibPaths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		libs[abs] = true
+	}
+
+	dashboards := []*FullDashboard{}
+	err := filepath.WalkDir(cfg.Directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == cfg.Directory {
+				return nil
+			}
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(d.Name(), ".") || libs[abs] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".jsonnet" {
+			return nil
+		}
+		output, err := vm.EvaluateFile(path)
+		if err != nil {
+			return fmt.Errorf("error evaluating %s: %w", path, err)
+		}
+		models, err := jsonnetModels(output)
+		if err != nil {
+			return fmt.Errorf("error evaluating %s: %w", path, err)
+		}
+
+		folder := &gapi.Folder{Title: "General"}
+		rel, err := filepath.Rel(cfg.Directory, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if rel != "." {
+			// Folders are created by title when dashboards are uploaded,
+			// they only need an ID other than the one of General.
+			folder = &gapi.Folder{ID: -1, Title: strings.Split(rel, string(filepath.Separator))[0]}
+		}
+		for _, model := range models {
+			board := &gapi.Dashboard{Model: model}
+			uid, err := getUID(board)
+			if err != nil {
+				return fmt.Errorf("dashboard of %s: %w", path, err)
+			}
+			dashboards = append(dashboards, &FullDashboard{
+				Dashboard: board,
+				Folder:    folder,
+				// Overlays are next to the .jsonnet files.
+				path: filepath.Join(filepath.Dir(path), uid+".json"),
+			})
+		}
+		return nil
+	})
+	return dashboards, err
+}
+
+func jsonnetModels(output string) ([]map[string]interface{}, error) {
+	var v interface{}
+	err := json.Unmarshal([]byte(output), &v)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case []interface{}:
+		models := make([]map[string]interface{}, 0, len(v))
+		for _, item := range v {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("not a dashboard: %v", item)
+			}
+			models = append(models, m)
+		}
+		return models, nil
+	case map[string]interface{}:
+		if _, ok := v["uid"]; ok {
+			return []map[string]interface{}{v}, nil
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		models := make([]map[string]interface{}, 0, len(v))
+		for _, k := range keys {
+			m, ok := v[k].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is not a dashboard", k)
+			}
+			models = append(models, m)
+		}
+		return models, nil
+	}
+	return nil, fmt.Errorf("not a dashboard: %v", v)
+}
+
+// validateJsonnet checks that only input instances evaluate jsonnet.
+func (cfg *config) validateJsonnet() error {
+	for _, instance := range cfg.Output {
+		if instance.Jsonnet != nil {
+			return fmt.Errorf("instance %s: jsonnet is only supported for input instances", instance.Name)
+		}
+	}
+	for _, instance := range cfg.Input {
+		if instance.Jsonnet != nil && instance.Jsonnet.Directory == "" {
+			return fmt.Errorf("instance %s: jsonnet requires a directory", instance.Name)
+		}
+	}
+	return nil
+}
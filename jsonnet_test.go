@@ -0,0 +1,79 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJsonnetDashboards(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	write("dashboards/vendor/dashboard.libsonnet", `{ new(uid, title):: { uid: uid, title: title, tags: [std.extVar("env")] } }`)
+	write("dashboards/vendor/ignored.jsonnet", `error "libraries are not evaluated"`)
+	write("dashboards/nodes.jsonnet", `local d = import "dashboard.libsonnet"; d.new("nodes", "Nodes")`)
+	write("dashboards/team/services.jsonnet", `local d = import "dashboard.libsonnet"; { api: d.new("api", "API"), web: d.new("web", "Web") }`)
+
+	cfg := &jsonnetConfig{
+		Directory: filepath.Join(dir, "dashboards"),
+		LibPaths:  []string{filepath.Join(dir, "dashboards", "vendor")},
+		ExtVars:   map[string]string{"env": "dev"},
+	}
+	dashboards, err := cfg.jsonnetDashboards()
+	require.NoError(t, err)
+	require.Len(t, dashboards, 3)
+
+	require.Equal(t, map[string]interface{}{"uid": "nodes", "title": "Nodes", "tags": []interface{}{"dev"}}, dashboards[0].Dashboard.Model)
+	require.Equal(t, "General", dashboards[0].Folder.Title)
+	require.Equal(t, filepath.Join(dir, "dashboards", "nodes.json"), dashboards[0].path)
+
+	for i, uid := range []string{"api", "web"} {
+		d := dashboards[i+1]
+		require.Equal(t, uid, d.Dashboard.Model["uid"])
+		require.Equal(t, "team", d.Folder.Title)
+		require.NotZero(t, d.Folder.ID)
+	}
+
+	// Dashboards are evaluated once, and changing them does not change the
+	// next ones.
+	write("dashboards/nodes.jsonnet", `error "evaluated again"`)
+	dashboards[0].Dashboard.Model["title"] = "Changed"
+	dashboards, err = cfg.jsonnetDashboards()
+	require.NoError(t, err)
+	require.Equal(t, "Nodes", dashboards[0].Dashboard.Model["title"])
+}
+
+func TestJsonnetRelativeLibPaths(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "vendor"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "vendor", "ignored.jsonnet"), []byte(`error "libraries are not evaluated"`), 0644))
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	cfg := &jsonnetConfig{Directory: dir, LibPaths: []string{"vendor"}}
+	dashboards, err := cfg.jsonnetDashboards()
+	require.NoError(t, err)
+	require.Empty(t, dashboards)
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// linkRewriter rewrites the links of dashboards of an input instance for an
+// output instance: absolute URLs of the input instance become URLs of the
+// output instance, and the UIDs of linked dashboards are mapped to the ones
+// of the output instance. uid returns the UIDs of dashboards which are not
+// dashboards of the input instance unchanged.
+type linkRewriter struct {
+	inputURL  string
+	outputURL string
+	uid       func(string) string
+	// dashboardPath matches the paths of dashboards, e.g. /d/<uid>/<slug>
+	// or /d-solo/<uid>, in relative links and in links to the output
+	// instance.
+	dashboardPath *regexp.Regexp
+}
+
+func newLinkRewriter(input, output grafanaInstance, uid func(string) string) *linkRewriter {
+	l := &linkRewriter{
+		inputURL:  strings.TrimSuffix(input.URL, "/"),
+		outputURL: strings.TrimSuffix(output.URL, "/"),
+		uid:       uid,
+	}
+	prefix := `^|[\s("'=]`
+	if l.outputURL != "" {
+		prefix += "|" + regexp.QuoteMeta(l.outputURL)
+	}
+	l.dashboardPath = regexp.MustCompile(`(` + prefix + `)(/d(?:-solo)?/)([A-Za-z0-9_-]+)`)
+	return l
+}
+
+// rewriteDashboard rewrites the links of a dashboard and of its library
+// panels: dashboard links, panel links, data links and the content of text
+// panels. Other strings, like queries, are left as they are.
+func (l *linkRewriter) rewriteDashboard(d *FullDashboard) {
+	l.rewriteLinks(d.Dashboard.Model["links"])
+	for _, p := range dashboardPanels(d.Dashboard.Model) {
+		if panel, ok := p.(map[string]interface{}); ok {
+			l.rewritePanel(panel)
+		}
+	}
+	for _, p := range d.LibraryPanels {
+		l.rewritePanel(p.Model)
+	}
+}
+
+func (l *linkRewriter) rewritePanel(panel map[string]interface{}) {
+	l.rewriteLinks(panel["links"])
+	fieldConfig, _ := panel["fieldConfig"].(map[string]interface{})
+	defaults, _ := fieldConfig["defaults"].(map[string]interface{})
+	l.rewriteLinks(defaults["links"])
+	overrides, _ := fieldConfig["overrides"].([]interface{})
+	for _, o := range overrides {
+		override, _ := o.(map[string]interface{})
+		properties, _ := override["properties"].([]interface{})
+		for _, p := range properties {
+			if property, ok := p.(map[string]interface{}); ok && property["id"] == "links" {
+				l.rewriteLinks(property["value"])
+			}
+		}
+	}
+
+	if panel["type"] != "text" {
+		return
+	}
+	if content, ok := panel["content"].(string); ok {
+		panel["content"] = l.rewriteString(content)
+	}
+	options, _ := panel["options"].(map[string]interface{})
+	if content, ok := options["content"].(string); ok {
+		options["content"] = l.rewriteString(content)
+	}
+}
+
+// rewriteLinks rewrites the URLs of a list of links.
+func (l *linkRewriter) rewriteLinks(v interface{}) {
+	links, _ := v.([]interface{})
+	for _, item := range links {
+		link, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if u, ok := link["url"].(string); ok {
+			link["url"] = l.rewriteString(u)
+		}
+	}
+}
+
+func (l *linkRewriter) rewriteString(s string) string {
+	if l.inputURL != "" && l.inputURL != l.outputURL {
+		s = strings.ReplaceAll(s, l.inputURL+"/", l.outputURL+"/")
+		if s == l.inputURL {
+			s = l.outputURL
+		}
+	}
+	if !strings.Contains(s, "/d") {
+		return s
+	}
+	return l.dashboardPath.ReplaceAllStringFunc(s, func(m string) string {
+		parts := l.dashboardPath.FindStringSubmatch(m)
+		return parts[1] + parts[2] + l.uid(parts[3])
+	})
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewriteLinks(t *testing.T) {
+	l := newLinkRewriter(
+		grafanaInstance{URL: "https://grafana-dev.example.com/"},
+		grafanaInstance{URL: "https://grafana.example.com"},
+		func(uid string) string { return "prod-" + uid },
+	)
+	for in, out := range map[string]string{
+		"https://grafana-dev.example.com/d/abc/nodes?var-x=${__value.raw}": "https://grafana.example.com/d/prod-abc/nodes?var-x=${__value.raw}",
+		"/d/abc/nodes": "/d/prod-abc/nodes",
+		"See [runbook](https://grafana-dev.example.com/d-solo/abc)": "See [runbook](https://grafana.example.com/d-solo/prod-abc)",
+		"https://grafana-dev.example.com.evil/x":                    "https://grafana-dev.example.com.evil/x",
+		"https://grafana-dev.example.com":                           "https://grafana.example.com",
+		"https://wiki.example.com/d/runbooks":                       "https://wiki.example.com/d/runbooks",
+	} {
+		require.Equal(t, out, l.rewriteString(in))
+	}
+}
+
+func TestRewriteDashboardLinks(t *testing.T) {
+	input := grafanaInstance{Name: "dev", URL: "https://grafana-dev.example.com", dashboardUIDs: map[string]bool{"abc": true}}
+	output := grafanaInstance{Name: "prod", URL: "https://grafana.example.com", UIDMappings: []uidMappingConfig{{Prefix: "prod-"}}}
+	d := &FullDashboard{Dashboard: &gapi.Dashboard{Model: mustModel(t, `{
+		"uid": "abc",
+		"description": "/d/abc",
+		"links": [{"url": "/d/abc"}, {"url": "/d/prod-only"}],
+		"panels": [
+			{
+				"type": "timeseries",
+				"targets": [{"expr": "rate(x{path=\"/d/abc\"}[5m])"}],
+				"fieldConfig": {
+					"defaults": {"links": [{"url": "https://grafana-dev.example.com/d/abc"}]},
+					"overrides": [{"properties": [{"id": "links", "value": [{"url": "/d/abc"}]}]}]
+				}
+			},
+			{"type": "row", "panels": [{"type": "text", "options": {"content": "[nodes](/d/abc)"}}]}
+		]
+	}`)}}
+	require.NoError(t, output.prepareDashboard(input, d))
+	require.Equal(t, mustModel(t, `{
+		"uid": "prod-abc",
+		"description": "/d/abc",
+		"links": [{"url": "/d/prod-abc"}, {"url": "/d/prod-only"}],
+		"panels": [
+			{
+				"type": "timeseries",
+				"targets": [{"expr": "rate(x{path=\"/d/abc\"}[5m])"}],
+				"fieldConfig": {
+					"defaults": {"links": [{"url": "https://grafana.example.com/d/prod-abc"}]},
+					"overrides": [{"properties": [{"id": "links", "value": [{"url": "/d/prod-abc"}]}]}]
+				}
+			},
+			{"type": "row", "panels": [{"type": "text", "options": {"content": "[nodes](/d/prod-abc)"}}]}
+		]
+	}`), mustRoundTrip(t, d.Dashboard.Model))
+}
@@ -16,6 +16,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 
 	"gopkg.in/alecthomas/kingpin.v2"
 	"gopkg.in/yaml.v2"
@@ -24,6 +25,11 @@ import (
 var (
 	app        = kingpin.New("dashboard-manager", "A command-line dashboard manager.")
 	configFile = app.Flag("config-file", "Path to the configuration file.").Short('c').Required().ExistingFile()
+	identity   = app.Flag("age-identity-file", "Path to the age identity file used to decrypt the configuration file.").Envar("DASHBOARD_MANAGER_AGE_IDENTITY_FILE").String()
+	gitCommit  = app.Flag("git-commit", "Git commit of the dashboards, recorded in uploaded dashboards.").Envar("DASHBOARD_MANAGER_GIT_COMMIT").String()
+	pipelineID = app.Flag("pipeline-id", "ID of the CI pipeline, recorded in uploaded dashboards.").Envar("DASHBOARD_MANAGER_PIPELINE_ID").String()
+
+	check = app.Command("check", "Check the configuration, connectivity and permissions.")
 
 	fetch          = app.Command("fetch", "Fetch dashboards from input grafana.")
 	fetchDirectory = fetch.Flag("output-directory", "Directory to fetch the dashboards to.").Required().String()
@@ -32,18 +38,60 @@ var (
 	compareDirectory = compare.Flag("dashboards-directory", "Directory where the dashboards were fetched.").Required().String()
 	compareResults   = compare.Flag("results", "File to write result to.").Required().String()
 
-	upload               = app.Command("upload", "Upload dashboards.")
-	uploadDirectory      = upload.Flag("dashboards-directory", "Directory where the dashboards were fetched.").Required().String()
-	uploadSource         = upload.Flag("input-instance", "Name of the output instance").Required().String()
-	uploadOutput         = upload.Flag("output-instance", "Name of the output instance").Required().String()
-	uploadDashboardsList = upload.Flag("dashboards", "Dashboards to upload").Required().Strings()
+	upload                     = app.Command("upload", "Upload dashboards.")
+	uploadDirectory            = upload.Flag("dashboards-directory", "Directory where the dashboards were fetched.").Required().String()
+	uploadSource               = upload.Flag("input-instance", "Name of the output instance").Required().String()
+	uploadOutput               = upload.Flag("output-instance", "Name of the output instance").Required().String()
+	uploadSourceOrg            = upload.Flag("input-org", "Name of the organization of the input instance").String()
+	uploadOutputOrg            = upload.Flag("output-org", "Name of the organization of the output instance").String()
+	uploadDashboardsList       = upload.Flag("dashboards", "Dashboards to upload").Strings()
+	uploadRuleGroupsList       = upload.Flag("alert-rule-groups", "Alert rule groups to upload, as <folder title>/<group>").Strings()
+	uploadContactPointsList    = upload.Flag("contact-points", "UIDs of the contact points to upload").Strings()
+	uploadMuteTimingsList      = upload.Flag("mute-timings", "Names of the mute timings to upload").Strings()
+	uploadNotificationPolicies = upload.Flag("notification-policies", "Upload the notification policies").Bool()
+	uploadForce                = upload.Flag("force", "Overwrite dashboards changed in the output instance since they were uploaded").Bool()
+	uploadPrefer               = upload.Flag("prefer", "Resolve merge conflicts: source, output, or [<uid>:]<path>=source|output").Strings()
 
 	snapshot               = app.Command("snapshot", "Upload snapshots.")
 	snapshotDirectory      = snapshot.Flag("dashboards-directory", "Directory where the dashboards were fetched.").Required().String()
 	snapshotSource         = snapshot.Flag("input-instance", "Name of the output instance").Required().String()
 	snapshotOutput         = snapshot.Flag("output-instance", "Name of the output instance").Required().String()
+	snapshotSourceOrg      = snapshot.Flag("input-org", "Name of the organization of the input instance").String()
+	snapshotOutputOrg      = snapshot.Flag("output-org", "Name of the organization of the output instance").String()
 	snapshotDashboardsList = snapshot.Flag("dashboards", "Dashboards to snapshot").Required().Strings()
 	snapshotExpire         = snapshot.Flag("expire", "Expiration time").Default("1h").Duration()
+
+	provision                = app.Command("provision-datasources", "Create or update datasources.")
+	provisionDirectory       = provision.Flag("dashboards-directory", "Directory where the dashboards were fetched.").Required().String()
+	provisionSource          = provision.Flag("input-instance", "Name of the input instance").Required().String()
+	provisionOutput          = provision.Flag("output-instance", "Name of the output instance").Required().String()
+	provisionSourceOrg       = provision.Flag("input-org", "Name of the organization of the input instance").String()
+	provisionOutputOrg       = provision.Flag("output-org", "Name of the organization of the output instance").String()
+	provisionDatasourcesList = provision.Flag("datasources", "Names of the datasources to provision, all by default").Strings()
+
+	backport               = app.Command("backport", "Backport dashboards changed in an output instance.")
+	backportDirectory      = backport.Flag("dashboards-directory", "Directory where the dashboards were fetched.").Required().String()
+	backportSource         = backport.Flag("input-instance", "Name of the input instance").Required().String()
+	backportOutput         = backport.Flag("output-instance", "Name of the output instance").Required().String()
+	backportSourceOrg      = backport.Flag("input-org", "Name of the organization of the input instance").String()
+	backportOutputOrg      = backport.Flag("output-org", "Name of the organization of the output instance").String()
+	backportDashboardsList = backport.Flag("dashboards", "Dashboards to backport").Required().Strings()
+	backportUpload         = backport.Flag("upload", "Upload the dashboards to the input instance instead of writing them in the dashboards directory").Bool()
+
+	adopt               = app.Command("adopt", "Mark dashboards of an output instance as managed.")
+	adoptOutput         = adopt.Flag("output-instance", "Name of the output instance").Required().String()
+	adoptOutputOrg      = adopt.Flag("output-org", "Name of the organization of the output instance").String()
+	adoptDashboardsList = adopt.Flag("dashboards", "Dashboards to adopt").Required().Strings()
+
+	status          = app.Command("status", "Show the promotion status of dashboards.")
+	statusDirectory = status.Flag("dashboards-directory", "Directory where the dashboards were fetched.").Required().String()
+
+	promote               = app.Command("promote", "Promote dashboards to a stage of the pipeline.")
+	promoteDirectory      = promote.Flag("dashboards-directory", "Directory where the dashboards were fetched.").Required().String()
+	promoteTo             = promote.Flag("to", "Name of the pipeline stage").Required().String()
+	promoteDashboardsList = promote.Flag("dashboards", "Dashboards to promote").Required().Strings()
+	promoteForce          = promote.Flag("force", "Overwrite dashboards changed in the output instance since they were uploaded").Bool()
+	promotePrefer         = promote.Flag("prefer", "Resolve merge conflicts: source, output, or [<uid>:]<path>=source|output").Strings()
 )
 
 type gitConfig struct {
@@ -52,13 +100,24 @@ type gitConfig struct {
 }
 
 type config struct {
-	Git    gitConfig         `yaml:"git_config"`
-	Input  []grafanaInstance `yaml:"grafana_instances_input"`
-	Output []grafanaInstance `yaml:"grafana_instances_output"`
+	Git       gitConfig         `yaml:"git_config"`
+	Input     []grafanaInstance `yaml:"grafana_instances_input"`
+	Output    []grafanaInstance `yaml:"grafana_instances_output"`
+	Pipeline  []stageConfig     `yaml:"pipeline"`
+	StateFile string            `yaml:"state_file"`
 }
 
 func main() {
 	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	case check.FullCommand():
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = checkInstances(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
 	case fetch.FullCommand():
 		cfg, err := loadConfig(*configFile)
 		if err != nil {
@@ -95,6 +154,51 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+	case provision.FullCommand():
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = provisionDatasources(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case adopt.FullCommand():
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = adoptDashboards(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case status.FullCommand():
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = showStatus(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case backport.FullCommand():
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = backportDashboards(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case promote.FullCommand():
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = promoteDashboards(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 }
 
@@ -103,7 +207,53 @@ func loadConfig(configFile string) (*config, error) {
 	if err != nil {
 		return nil, err
 	}
+	data, err = expandConfig(data, &ageDecrypter{identityFile: *identity})
+	if err != nil {
+		return nil, err
+	}
 	cfg := &config{}
 	err = yaml.UnmarshalStrict(data, cfg)
-	return cfg, err
+	if err != nil {
+		return nil, err
+	}
+	for i := range cfg.Input {
+		cfg.Input[i].resolveGeneratorPaths(filepath.Dir(configFile))
+	}
+	for _, instances := range [][]grafanaInstance{cfg.Input, cfg.Output} {
+		for _, instance := range instances {
+			err = instance.validateAuth()
+			if err != nil {
+				return nil, err
+			}
+			err = instance.validateTemplateValues()
+			if err != nil {
+				return nil, err
+			}
+			err = instance.validateUIDMappings()
+			if err != nil {
+				return nil, err
+			}
+			err = instance.validateGenerators()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = cfg.validateOrgs()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.validatePipeline()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.validateOwners()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.validateJsonnet()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
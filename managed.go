@@ -0,0 +1,108 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// managedTag is the tag of the dashboards uploaded by dashboard-manager.
+// Dashboards of output instances without it are never overwritten, unless
+// they are adopted.
+const managedTag = "dashboard-manager"
+
+func isManaged(tags []string) bool {
+	for _, t := range tags {
+		if t == managedTag {
+			return true
+		}
+	}
+	return false
+}
+
+// stampDashboard adds the managed tag to a dashboard.
+func stampDashboard(b *gapi.Dashboard) {
+	tags := getTags(b)
+	if isManaged(tags) {
+		return
+	}
+	stamped := []interface{}{}
+	for _, t := range tags {
+		stamped = append(stamped, t)
+	}
+	b.Model["tags"] = append(stamped, managedTag)
+}
+
+// unstampDashboard removes the managed tag and the provenance link from a
+// dashboard, so that it can be compared with the dashboards of the input
+// instances.
+func unstampDashboard(b *gapi.Dashboard) {
+	removeProvenance(b)
+	tags := getTags(b)
+	if !isManaged(tags) {
+		return
+	}
+	unstamped := []interface{}{}
+	for _, t := range tags {
+		if t != managedTag {
+			unstamped = append(unstamped, t)
+		}
+	}
+	b.Model["tags"] = unstamped
+}
+
+// unmanagedError is returned when a dashboard of an output instance was not
+// uploaded by dashboard-manager.
+func unmanagedError(output grafanaInstance, uid string) error {
+	return fmt.Errorf("dashboard %s of %s is not managed by dashboard-manager, adopt it first", uid, instanceKey(output))
+}
+
+// adoptDashboards stamps dashboards of an output instance, so that they can
+// be overwritten by upload.
+func adoptDashboards(cfg *config) error {
+	output := cfg.instance(cfg.Output, *adoptOutput)
+	if output == nil {
+		return errors.New("output instance not found")
+	}
+	outputInstance, err := output.orgInstance(*adoptOutputOrg)
+	if err != nil {
+		return err
+	}
+	client, err := outputInstance.client()
+	if err != nil {
+		return err
+	}
+
+	for _, uid := range *adoptDashboardsList {
+		board, err := client.DashboardByUID(uid)
+		if err != nil {
+			return fmt.Errorf("error fetching %s: %w", uid, err)
+		}
+		if isManaged(getTags(board)) {
+			fmt.Printf("Dashboard %s is already managed.\n", uid)
+			continue
+		}
+		stampDashboard(board)
+		board.Folder = board.Meta.Folder
+		board.Overwrite = true
+		board.Message = "Adopted by dashboard-manager"
+		_, err = client.NewDashboard(*board)
+		if err != nil {
+			return fmt.Errorf("error adopting %s: %w", uid, err)
+		}
+	}
+	return nil
+}
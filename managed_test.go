@@ -0,0 +1,41 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStampDashboard(t *testing.T) {
+	b := &gapi.Dashboard{Model: mustModel(t, `{"uid": "nodes", "tags": ["infra"]}`)}
+	require.False(t, isManaged(getTags(b)))
+
+	stampDashboard(b)
+	require.True(t, isManaged(getTags(b)))
+	stampDashboard(b)
+	require.Equal(t, []string{"infra", managedTag}, getTags(b))
+
+	addProvenance(b, grafanaInstance{Name: "dev", URL: "https://dev.example.com"}, "nodes", &promotionRecord{Source: "dev"})
+	unstampDashboard(b)
+	require.Equal(t, mustModel(t, `{"uid": "nodes", "tags": ["infra"], "links": []}`), mustRoundTrip(t, b.Model))
+	unstampDashboard(b)
+	require.Equal(t, []string{"infra"}, getTags(b))
+}
+
+func TestUnmanagedError(t *testing.T) {
+	output := grafanaInstance{Name: "prod", org: &orgConfig{Name: "main"}}
+	require.EqualError(t, unmanagedError(output, "nodes"), "dashboard nodes of prod/main is not managed by dashboard-manager, adopt it first")
+}
@@ -0,0 +1,245 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	preferSource = "source"
+	preferOutput = "output"
+)
+
+// missing is the value of keys and array items which do not exist on one
+// side of a merge.
+type missingValue struct{}
+
+var missing = &missingValue{}
+
+// identityKeys are the keys which identify the items of arrays, e.g. panels
+// by id, targets by refId and variables by name, so that arrays are merged
+// item by item.
+var identityKeys = []string{"id", "refId", "name", "uid"}
+
+// mergeResolver resolves the conflicts of a merge with --prefer values, which
+// are source or output, for all the conflicts, or <path>=source|output or
+// <uid>:<path>=source|output for the conflicts at a path.
+type mergeResolver struct {
+	uid    string
+	prefer []string
+}
+
+func (m mergeResolver) resolve(path string) string {
+	resolution := ""
+	for _, p := range m.prefer {
+		i := strings.LastIndex(p, "=")
+		if i < 0 {
+			resolution = p
+			continue
+		}
+		target, side := p[:i], p[i+1:]
+		if target == path || target == m.uid+":"+path {
+			return side
+		}
+	}
+	return resolution
+}
+
+// validatePrefer checks the --prefer values.
+func validatePrefer(prefer []string) error {
+	for _, p := range prefer {
+		side := p[strings.LastIndex(p, "=")+1:]
+		if side != preferSource && side != preferOutput {
+			return fmt.Errorf("invalid --prefer %s: must be source, output or <path>=source|output", p)
+		}
+	}
+	return nil
+}
+
+// mergeDashboards merges the changes made to a dashboard in the source and
+// in the output instance since base was uploaded. The models must use the
+// datasources of the output instance. It returns the merged model and the
+// paths of the conflicts which were not resolved.
+func mergeDashboards(base, source, output map[string]interface{}, resolver mergeResolver) (map[string]interface{}, []string, error) {
+	var b, s, o interface{}
+	for _, v := range []struct {
+		model map[string]interface{}
+		dest  *interface{}
+	}{{base, &b}, {source, &s}, {output, &o}} {
+		data, err := json.Marshal(v.model)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = json.Unmarshal(data, v.dest)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, k := range []string{"id", "version", "iteration"} {
+			delete((*v.dest).(map[string]interface{}), k)
+		}
+	}
+
+	conflicts := []string{}
+	merged := merge3(b, s, o, "", resolver, &conflicts)
+	return merged.(map[string]interface{}), conflicts, nil
+}
+
+func merge3(base, source, output interface{}, path string, resolver mergeResolver, conflicts *[]string) interface{} {
+	switch {
+	case reflect.DeepEqual(source, output):
+		return source
+	case reflect.DeepEqual(base, source):
+		return output
+	case reflect.DeepEqual(base, output):
+		return source
+	}
+
+	baseMap, _ := base.(map[string]interface{})
+	sourceMap, sourceOK := source.(map[string]interface{})
+	outputMap, outputOK := output.(map[string]interface{})
+	if sourceOK && outputOK {
+		return mergeMaps(baseMap, sourceMap, outputMap, path, resolver, conflicts)
+	}
+
+	baseSlice, _ := base.([]interface{})
+	sourceSlice, sourceOK := source.([]interface{})
+	outputSlice, outputOK := output.([]interface{})
+	if sourceOK && outputOK {
+		if key := identityKey(baseSlice, sourceSlice, outputSlice); key != "" {
+			return mergeSlices(key, baseSlice, sourceSlice, outputSlice, path, resolver, conflicts)
+		}
+	}
+
+	if path == "" {
+		path = "/"
+	}
+	switch resolver.resolve(path) {
+	case preferSource:
+		return source
+	case preferOutput:
+		return output
+	}
+	*conflicts = append(*conflicts, path)
+	return source
+}
+
+func mergeMaps(base, source, output map[string]interface{}, path string, resolver mergeResolver, conflicts *[]string) interface{} {
+	keys := make(map[string]bool)
+	for _, m := range []map[string]interface{}{base, source, output} {
+		for k := range m {
+			keys[k] = true
+		}
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for k := range keys {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Strings(sortedKeys)
+
+	merged := make(map[string]interface{})
+	for _, k := range sortedKeys {
+		v := merge3(lookup(base, k), lookup(source, k), lookup(output, k), path+"/"+k, resolver, conflicts)
+		if v != missing {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+func lookup(m map[string]interface{}, k string) interface{} {
+	if v, ok := m[k]; ok {
+		return v
+	}
+	return missing
+}
+
+// identityKey returns the key which identifies the items of the arrays, if
+// they are all objects with a unique value for that key.
+func identityKey(slices ...[]interface{}) string {
+	for _, key := range identityKeys {
+		ok := true
+		for _, s := range slices {
+			seen := make(map[string]bool)
+			for _, item := range s {
+				id, found := itemID(item, key)
+				if !found || seen[id] {
+					ok = false
+					break
+				}
+				seen[id] = true
+			}
+		}
+		if ok {
+			return key
+		}
+	}
+	return ""
+}
+
+func itemID(item interface{}, key string) (string, bool) {
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	v, ok := m[key]
+	if !ok || v == nil {
+		return "", false
+	}
+	return fmt.Sprint(v), true
+}
+
+// mergeSlices merges arrays item by item, keeping the order of the source and
+// appending the items added in the output instance.
+func mergeSlices(key string, base, source, output []interface{}, path string, resolver mergeResolver, conflicts *[]string) interface{} {
+	index := func(s []interface{}) (map[string]interface{}, []string) {
+		items := make(map[string]interface{})
+		order := []string{}
+		for _, item := range s {
+			id, _ := itemID(item, key)
+			items[id] = item
+			order = append(order, id)
+		}
+		return items, order
+	}
+	baseItems, _ := index(base)
+	sourceItems, sourceOrder := index(source)
+	outputItems, outputOrder := index(output)
+
+	order := sourceOrder
+	for _, id := range outputOrder {
+		if _, ok := sourceItems[id]; !ok {
+			order = append(order, id)
+		}
+	}
+
+	merged := []interface{}{}
+	for _, id := range order {
+		v := merge3(lookupItem(baseItems, id), lookupItem(sourceItems, id), lookupItem(outputItems, id), path+"/"+key+"="+id, resolver, conflicts)
+		if v != missing {
+			merged = append(merged, v)
+		}
+	}
+	return merged
+}
+
+func lookupItem(items map[string]interface{}, id string) interface{} {
+	if v, ok := items[id]; ok {
+		return v
+	}
+	return missing
+}
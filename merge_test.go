@@ -0,0 +1,53 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeDashboards(t *testing.T) {
+	base := mustModel(t, `{"title": "a", "version": 3, "panels": [
+		{"id": 1, "title": "cpu", "targets": [{"refId": "A", "expr": "cpu"}]},
+		{"id": 2, "title": "mem"}]}`)
+	// The source changes the title and the query of panel 1.
+	source := mustModel(t, `{"title": "b", "panels": [
+		{"id": 1, "title": "cpu", "targets": [{"refId": "A", "expr": "rate(cpu[5m])"}]},
+		{"id": 2, "title": "mem"}]}`)
+	// The output adds a target to panel 1, renames panel 2 and adds panel 3.
+	output := mustModel(t, `{"title": "a", "version": 5, "panels": [
+		{"id": 1, "title": "cpu", "targets": [{"refId": "A", "expr": "cpu"}, {"refId": "B", "expr": "load"}]},
+		{"id": 2, "title": "memory"},
+		{"id": 3, "title": "disk"}]}`)
+
+	merged, conflicts, err := mergeDashboards(base, source, output, mergeResolver{})
+	require.NoError(t, err)
+	require.Empty(t, conflicts)
+	require.Equal(t, mustModel(t, `{"title": "b", "panels": [
+		{"id": 1, "title": "cpu", "targets": [{"refId": "A", "expr": "rate(cpu[5m])"}, {"refId": "B", "expr": "load"}]},
+		{"id": 2, "title": "memory"},
+		{"id": 3, "title": "disk"}]}`), merged)
+
+	// Both sides change panel 2.
+	source["panels"].([]interface{})[1].(map[string]interface{})["title"] = "ram"
+	_, conflicts, err = mergeDashboards(base, source, output, mergeResolver{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"/panels/id=2/title"}, conflicts)
+
+	merged, conflicts, err = mergeDashboards(base, source, output, mergeResolver{uid: "x", prefer: []string{"x:/panels/id=2/title=output"}})
+	require.NoError(t, err)
+	require.Empty(t, conflicts)
+	require.Equal(t, "memory", merged["panels"].([]interface{})[1].(map[string]interface{})["title"])
+}
@@ -0,0 +1,533 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-test/deep"
+	"github.com/google/go-cmp/cmp"
+)
+
+// redacted is the value returned by Grafana instead of the secure settings of
+// contact points.
+const redacted = "[REDACTED]"
+
+type contactPoint struct {
+	UID                   string                 `json:"uid"`
+	Name                  string                 `json:"name"`
+	Type                  string                 `json:"type"`
+	Settings              map[string]interface{} `json:"settings"`
+	DisableResolveMessage bool                   `json:"disableResolveMessage"`
+}
+
+// contactPointConfig overrides the settings of the contact points with the
+// given name when they are uploaded to an output instance. This is how
+// secrets, which are never fetched, are provided.
+type contactPointConfig struct {
+	Name          string            `yaml:"name"`
+	Type          string            `yaml:"type"`
+	Settings      map[string]string `yaml:"settings"`
+	SettingsFiles map[string]string `yaml:"settings_files"`
+}
+
+func contactPoints(api *apiClient) ([]*contactPoint, error) {
+	cps := []*contactPoint{}
+	err := api.request("GET", "/api/v1/provisioning/contact-points", nil, &cps)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return cps, err
+}
+
+func notificationPolicies(api *apiClient) (map[string]interface{}, error) {
+	policies := map[string]interface{}{}
+	err := api.request("GET", "/api/v1/provisioning/policies", nil, &policies)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return policies, err
+}
+
+func muteTimings(api *apiClient) ([]map[string]interface{}, error) {
+	mts := []map[string]interface{}{}
+	err := api.request("GET", "/api/v1/provisioning/mute-timings", nil, &mts)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return mts, err
+}
+
+func muteTimingName(mt map[string]interface{}) string {
+	name, _ := mt["name"].(string)
+	return name
+}
+
+// stripSecrets removes the redacted settings of a contact point, so that they
+// are not written in the fetched files.
+func stripSecrets(cp *contactPoint) {
+	for k, v := range cp.Settings {
+		if v == redacted {
+			delete(cp.Settings, k)
+		}
+	}
+}
+
+// applyContactPointConfig applies the settings configured for an output
+// instance to a contact point.
+func applyContactPointConfig(cp *contactPoint, cfgs []contactPointConfig) error {
+	for _, c := range cfgs {
+		if c.Name != cp.Name {
+			continue
+		}
+		if c.Type != "" {
+			cp.Type = c.Type
+		}
+		if cp.Settings == nil {
+			cp.Settings = make(map[string]interface{})
+		}
+		for k, v := range c.Settings {
+			cp.Settings[k] = v
+		}
+		for k, f := range c.SettingsFiles {
+			fileContent, err := ioutil.ReadFile(f)
+			if err != nil {
+				return fmt.Errorf("error reading setting %s of contact point %s: %w", k, cp.Name, err)
+			}
+			cp.Settings[k] = strings.TrimSpace(string(fileContent))
+		}
+	}
+	return nil
+}
+
+// secretSettings returns the settings of a contact point which may be
+// secrets: the ones set by the configuration of the output instance, which
+// often come from environment variables, files or encrypted values, and the
+// ones redacted by Grafana.
+func secretSettings(cp, outputCP *contactPoint, cfgs []contactPointConfig) map[string]bool {
+	secrets := make(map[string]bool)
+	for _, c := range cfgs {
+		if c.Name != cp.Name {
+			continue
+		}
+		for k := range c.Settings {
+			secrets[k] = true
+		}
+		for k := range c.SettingsFiles {
+			secrets[k] = true
+		}
+	}
+	for _, p := range []*contactPoint{cp, outputCP} {
+		for k, v := range p.Settings {
+			if v == redacted {
+				secrets[k] = true
+			}
+		}
+	}
+	return secrets
+}
+
+// redactContactPoint returns a copy of a contact point without the secret
+// settings, so that they are not written in compare results.
+func redactContactPoint(cp *contactPoint, secrets map[string]bool) *contactPoint {
+	redactedCP := *cp
+	redactedCP.Settings = make(map[string]interface{}, len(cp.Settings))
+	for k, v := range cp.Settings {
+		if secrets[k] {
+			v = redacted
+		}
+		redactedCP.Settings[k] = v
+	}
+	return &redactedCP
+}
+
+// contactPointDiff shows the differences between a contact point and the one
+// of an output instance, without secrets.
+func contactPointDiff(cp, outputCP *contactPoint, cfgs []contactPointConfig) string {
+	secrets := secretSettings(cp, outputCP, cfgs)
+	return cmp.Diff(redactContactPoint(cp, secrets), redactContactPoint(outputCP, secrets))
+}
+
+// mapReceivers replaces the receivers of a notification policy tree with
+// the contact points configured for the output instance.
+func mapReceivers(policy map[string]interface{}, receivers map[string]string) {
+	if receiver, ok := policy["receiver"].(string); ok {
+		if r, ok := receivers[receiver]; ok {
+			policy["receiver"] = r
+		}
+	}
+	routes, _ := policy["routes"].([]interface{})
+	for _, route := range routes {
+		if r, ok := route.(map[string]interface{}); ok {
+			mapReceivers(r, receivers)
+		}
+	}
+}
+
+func fetchNotifications(api *apiClient, basepath string) error {
+	alertingPath := filepath.Join(basepath, alertingDirectory)
+
+	cps, err := contactPoints(api)
+	if err != nil {
+		return err
+	}
+	if len(cps) > 0 {
+		cpPath := filepath.Join(alertingPath, "contact-points")
+		err = os.MkdirAll(cpPath, os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("error making directory %s: %w", cpPath, err)
+		}
+		for _, cp := range cps {
+			stripSecrets(cp)
+			err = writeJSON(filepath.Join(cpPath, url.PathEscape(cp.UID)+".json"), cp)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	mts, err := muteTimings(api)
+	if err != nil {
+		return err
+	}
+	if len(mts) > 0 {
+		mtPath := filepath.Join(alertingPath, "mute-timings")
+		err = os.MkdirAll(mtPath, os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("error making directory %s: %w", mtPath, err)
+		}
+		for _, mt := range mts {
+			err = writeJSON(filepath.Join(mtPath, url.PathEscape(muteTimingName(mt))+".json"), mt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	policies, err := notificationPolicies(api)
+	if err != nil {
+		return err
+	}
+	if policies != nil {
+		err = lazyMkdir(alertingPath)
+		if err != nil {
+			return fmt.Errorf("error making directory %s: %w", alertingPath, err)
+		}
+		err = writeJSON(filepath.Join(alertingPath, "policies.json"), policies)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readContactPoints(basepath string) ([]*contactPoint, error) {
+	cps := []*contactPoint{}
+	err := readJSONDirectory(filepath.Join(basepath, alertingDirectory, "contact-points"), func() interface{} {
+		cp := &contactPoint{}
+		cps = append(cps, cp)
+		return cp
+	})
+	return cps, err
+}
+
+func readMuteTimings(basepath string) ([]map[string]interface{}, error) {
+	mts := []map[string]interface{}{}
+	err := readJSONDirectory(filepath.Join(basepath, alertingDirectory, "mute-timings"), func() interface{} {
+		mts = append(mts, map[string]interface{}{})
+		return &mts[len(mts)-1]
+	})
+	return mts, err
+}
+
+// readNotificationPolicies returns nil if no notification policies were
+// fetched.
+func readNotificationPolicies(basepath string) (map[string]interface{}, error) {
+	path := filepath.Join(basepath, alertingDirectory, "policies.json")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	policies := map[string]interface{}{}
+	err := readJSON(path, &policies)
+	return policies, err
+}
+
+// equalContactPoints compares two contact points. Secure settings can not be
+// read back from Grafana, so they are ignored.
+func equalContactPoints(a, b *contactPoint) bool {
+	if a.Name != b.Name || a.Type != b.Type || a.DisableResolveMessage != b.DisableResolveMessage {
+		return false
+	}
+	settingsA := make(map[string]interface{})
+	settingsB := make(map[string]interface{})
+	for k, v := range a.Settings {
+		if v != redacted && b.Settings[k] != redacted {
+			settingsA[k] = v
+		}
+	}
+	for k, v := range b.Settings {
+		if v != redacted && a.Settings[k] != redacted {
+			settingsB[k] = v
+		}
+	}
+	return deep.Equal(settingsA, settingsB) == nil
+}
+
+func equalAlertingModels(a, b map[string]interface{}) bool {
+	reset := func(m map[string]interface{}) map[string]interface{} {
+		o := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			o[k] = v
+		}
+		delete(o, "provenance")
+		delete(o, "version")
+		return o
+	}
+	return deep.Equal(reset(a), reset(b)) == nil
+}
+
+func uploadContactPoint(api *apiClient, cp *contactPoint, existing []*contactPoint) error {
+	for _, e := range existing {
+		if e.UID == cp.UID {
+			return api.request("PUT", "/api/v1/provisioning/contact-points/"+url.PathEscape(cp.UID), cp, nil)
+		}
+	}
+	return api.request("POST", "/api/v1/provisioning/contact-points", cp, nil)
+}
+
+func uploadMuteTiming(api *apiClient, mt map[string]interface{}, existing []map[string]interface{}) error {
+	name := muteTimingName(mt)
+	for _, e := range existing {
+		if muteTimingName(e) == name {
+			return api.request("PUT", "/api/v1/provisioning/mute-timings/"+url.PathEscape(name), mt, nil)
+		}
+	}
+	return api.request("POST", "/api/v1/provisioning/mute-timings", mt, nil)
+}
+
+func putNotificationPolicies(api *apiClient, policies map[string]interface{}) error {
+	return api.request("PUT", "/api/v1/provisioning/policies", policies, nil)
+}
+
+// compareNotifications compares the contact points, mute timings and
+// notification policies of the input instances with the ones of an output
+// instance.
+func compareNotifications(inputs []grafanaInstance, outputInstance grafanaInstance) ([]dashboardDiff, error) {
+	diffs := []dashboardDiff{}
+	api, err := outputInstance.api()
+	if err != nil {
+		return nil, err
+	}
+	outputCPs, err := contactPoints(api)
+	if err != nil {
+		return nil, err
+	}
+	outputMTs, err := muteTimings(api)
+	if err != nil {
+		return nil, err
+	}
+	outputPolicies, err := notificationPolicies(api)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, instance := range inputs {
+		basepath := instance.path(*compareDirectory)
+
+		cps, err := readContactPoints(basepath)
+		if err != nil {
+			return nil, err
+		}
+		for _, cp := range cps {
+			err = applyContactPointConfig(cp, outputInstance.ContactPoints)
+			if err != nil {
+				return nil, err
+			}
+			var outputCP *contactPoint
+			for _, o := range outputCPs {
+				if o.UID == cp.UID {
+					outputCP = o
+					break
+				}
+			}
+			if outputCP == nil {
+				fmt.Printf("Contact point %s (%s) is new.\n", cp.Name, cp.UID)
+				diffs = append(diffs, dashboardDiff{
+					Kind:      kindContactPoint,
+					Action:    "new",
+					Source:    instance.Name,
+					SourceOrg: instance.orgName(),
+					UID:       cp.UID,
+					Title:     cp.Name,
+				})
+			} else if !equalContactPoints(cp, outputCP) {
+				fmt.Printf("Contact point %s (%s) is different.\n", cp.Name, cp.UID)
+				diffs = append(diffs, dashboardDiff{
+					Kind:      kindContactPoint,
+					Action:    "modify",
+					Source:    instance.Name,
+					SourceOrg: instance.orgName(),
+					UID:       cp.UID,
+					Title:     cp.Name,
+					Diff:      contactPointDiff(cp, outputCP, outputInstance.ContactPoints),
+				})
+			}
+		}
+
+		mts, err := readMuteTimings(basepath)
+		if err != nil {
+			return nil, err
+		}
+		for _, mt := range mts {
+			name := muteTimingName(mt)
+			var outputMT map[string]interface{}
+			for _, o := range outputMTs {
+				if muteTimingName(o) == name {
+					outputMT = o
+					break
+				}
+			}
+			if outputMT == nil {
+				fmt.Printf("Mute timing %s is new.\n", name)
+				diffs = append(diffs, dashboardDiff{
+					Kind:      kindMuteTiming,
+					Action:    "new",
+					Source:    instance.Name,
+					SourceOrg: instance.orgName(),
+					UID:       name,
+					Title:     name,
+				})
+			} else if !equalAlertingModels(mt, outputMT) {
+				fmt.Printf("Mute timing %s is different.\n", name)
+				diffs = append(diffs, dashboardDiff{
+					Kind:      kindMuteTiming,
+					Action:    "modify",
+					Source:    instance.Name,
+					SourceOrg: instance.orgName(),
+					UID:       name,
+					Title:     name,
+					Diff:      cmp.Diff(mt, outputMT),
+				})
+			}
+		}
+
+		policies, err := readNotificationPolicies(basepath)
+		if err != nil {
+			return nil, err
+		}
+		if policies != nil {
+			mapReceivers(policies, outputInstance.Receivers)
+		}
+		if policies != nil && !equalAlertingModels(policies, outputPolicies) {
+			fmt.Printf("Notification policies are different.\n")
+			diffs = append(diffs, dashboardDiff{
+				Kind:      kindNotificationPolicies,
+				Action:    "modify",
+				Source:    instance.Name,
+				SourceOrg: instance.orgName(),
+				Title:     "Notification policies",
+				Diff:      cmp.Diff(policies, outputPolicies),
+			})
+		}
+	}
+	return diffs, nil
+}
+
+// uploadNotifications uploads the contact points and mute timings before the
+// notification policies that reference them.
+func uploadNotifications(outputInstance grafanaInstance, basepath string) error {
+	api, err := outputInstance.api()
+	if err != nil {
+		return err
+	}
+
+	if len(*uploadContactPointsList) > 0 {
+		cps, err := readContactPoints(basepath)
+		if err != nil {
+			return err
+		}
+		existing, err := contactPoints(api)
+		if err != nil {
+			return err
+		}
+		for _, uid := range *uploadContactPointsList {
+			var cp *contactPoint
+			for _, c := range cps {
+				if c.UID == uid {
+					cp = c
+					break
+				}
+			}
+			if cp == nil {
+				return fmt.Errorf("contact point %s not found", uid)
+			}
+			err = applyContactPointConfig(cp, outputInstance.ContactPoints)
+			if err != nil {
+				return err
+			}
+			err = uploadContactPoint(api, cp, existing)
+			if err != nil {
+				return fmt.Errorf("error uploading contact point %s: %v", uid, err)
+			}
+		}
+	}
+
+	if len(*uploadMuteTimingsList) > 0 {
+		mts, err := readMuteTimings(basepath)
+		if err != nil {
+			return err
+		}
+		existing, err := muteTimings(api)
+		if err != nil {
+			return err
+		}
+		for _, name := range *uploadMuteTimingsList {
+			var mt map[string]interface{}
+			for _, m := range mts {
+				if muteTimingName(m) == name {
+					mt = m
+					break
+				}
+			}
+			if mt == nil {
+				return fmt.Errorf("mute timing %s not found", name)
+			}
+			err = uploadMuteTiming(api, mt, existing)
+			if err != nil {
+				return fmt.Errorf("error uploading mute timing %s: %v", name, err)
+			}
+		}
+	}
+
+	if *uploadNotificationPolicies {
+		policies, err := readNotificationPolicies(basepath)
+		if err != nil {
+			return err
+		}
+		if policies == nil {
+			return errors.New("notification policies not found")
+		}
+		mapReceivers(policies, outputInstance.Receivers)
+		err = putNotificationPolicies(api, policies)
+		if err != nil {
+			return fmt.Errorf("error uploading notification policies: %v", err)
+		}
+	}
+	return nil
+}
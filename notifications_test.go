@@ -0,0 +1,72 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContactPointSecrets(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "webhook")
+	require.NoError(t, ioutil.WriteFile(secret, []byte("https://hooks.example.com/s3cr3t\n"), 0644))
+	cfgs := []contactPointConfig{{
+		Name:          "oncall",
+		Settings:      map[string]string{"token": "t0k3n"},
+		SettingsFiles: map[string]string{"url": secret},
+	}}
+
+	cp := &contactPoint{UID: "a", Name: "oncall", Type: "slack", Settings: map[string]interface{}{"recipient": "#dev-alerts", "password": redacted}}
+	require.NoError(t, applyContactPointConfig(cp, cfgs))
+	require.Equal(t, map[string]interface{}{
+		"recipient": "#dev-alerts",
+		"password":  redacted,
+		"token":     "t0k3n",
+		"url":       "https://hooks.example.com/s3cr3t",
+	}, cp.Settings)
+
+	outputCP := &contactPoint{UID: "a", Name: "oncall", Type: "slack", Settings: map[string]interface{}{"recipient": "#alerts", "token": "old-t0k3n", "url": redacted, "password": "p4ss"}}
+	require.False(t, equalContactPoints(cp, outputCP))
+	diff := contactPointDiff(cp, outputCP, cfgs)
+	require.Contains(t, diff, "#dev-alerts")
+	for _, secret := range []string{"s3cr3t", "t0k3n", "p4ss"} {
+		require.NotContains(t, diff, secret)
+	}
+	require.Equal(t, "https://hooks.example.com/s3cr3t", cp.Settings["url"])
+	require.Equal(t, "t0k3n", cp.Settings["token"])
+}
+
+func TestMapReceivers(t *testing.T) {
+	policy := map[string]interface{}{
+		"receiver": "dev-slack",
+		"routes": []interface{}{
+			map[string]interface{}{"receiver": "dev-email"},
+			map[string]interface{}{"receiver": "other", "routes": []interface{}{
+				map[string]interface{}{"receiver": "dev-slack"},
+			}},
+		},
+	}
+	mapReceivers(policy, map[string]string{"dev-slack": "oncall", "dev-email": "team"})
+	require.Equal(t, map[string]interface{}{
+		"receiver": "oncall",
+		"routes": []interface{}{
+			map[string]interface{}{"receiver": "team"},
+			map[string]interface{}{"receiver": "other", "routes": []interface{}{
+				map[string]interface{}{"receiver": "oncall"},
+			}},
+		},
+	}, policy)
+}
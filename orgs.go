@@ -0,0 +1,186 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+// orgConfig is a Grafana organization of an instance. Organizations are
+// selected with the X-Grafana-Org-Id header, which Grafana only honours
+// without tokens, e.g. with basic auth: tokens belong to one organization.
+type orgConfig struct {
+	ID   int64  `yaml:"id"`
+	Name string `yaml:"name"`
+	// InputOrg is, for organizations of output instances, the name of the
+	// input organization uploaded to this organization. Defaults to Name.
+	InputOrg string `yaml:"input_org"`
+}
+
+// orgName returns the name of the organization of the instance, which is
+// also the name of its directory in the instance directory. It is empty for
+// instances that do not declare organizations.
+func (g *grafanaInstance) orgName() string {
+	if g.org == nil {
+		return ""
+	}
+	if g.org.Name != "" {
+		return g.org.Name
+	}
+	return strconv.FormatInt(g.org.ID, 10)
+}
+
+// path returns the directory of the instance, or of its organization, in the
+// given dashboards directory.
+func (g *grafanaInstance) path(directory string) string {
+	return filepath.Join(directory, g.Name, g.orgName())
+}
+
+// orgInstances returns a copy of the instance for each of its organizations,
+// or the instance itself if it does not declare organizations. Organizations
+// declared by name only are looked up, which requires a Grafana server admin.
+func (g grafanaInstance) orgInstances() ([]grafanaInstance, error) {
+	if len(g.Orgs) == 0 {
+		return []grafanaInstance{g}, nil
+	}
+	instances := make([]grafanaInstance, 0, len(g.Orgs))
+	for i := range g.Orgs {
+		org := g.Orgs[i]
+		if org.ID == 0 {
+			client, err := g.client()
+			if err != nil {
+				return nil, err
+			}
+			o, err := client.OrgByName(org.Name)
+			if err != nil {
+				return nil, fmt.Errorf("error looking up organization %s of %s: %w", org.Name, g.Name, err)
+			}
+			org.ID = o.ID
+		}
+		instance := g
+		instance.org = &org
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// orgInstance returns the copy of the instance for the organization with the
+// given name. The name can be omitted if the instance has at most one
+// organization.
+func (g grafanaInstance) orgInstance(name string) (grafanaInstance, error) {
+	instances, err := g.orgInstances()
+	if err != nil {
+		return g, err
+	}
+	if name == "" {
+		if len(instances) > 1 {
+			return g, fmt.Errorf("instance %s has several organizations, one must be selected", g.Name)
+		}
+		return instances[0], nil
+	}
+	for _, i := range instances {
+		if i.orgName() == name {
+			return i, nil
+		}
+	}
+	return g, fmt.Errorf("organization %s not found in %s", name, g.Name)
+}
+
+// outputOrgInstance returns the copy of an output instance for the given
+// organization or, if name is empty, for the organization the input
+// organization is uploaded to.
+func (g grafanaInstance) outputOrgInstance(name string, input grafanaInstance) (grafanaInstance, error) {
+	if name != "" || len(g.Orgs) <= 1 {
+		return g.orgInstance(name)
+	}
+	instances, err := g.orgInstances()
+	if err != nil {
+		return g, err
+	}
+	for _, i := range instances {
+		if i.receivesOrg(input) {
+			return i, nil
+		}
+	}
+	return g, fmt.Errorf("no organization of %s receives %s", g.Name, input.orgName())
+}
+
+// receivesOrg returns true if the organization of the input instance is
+// uploaded to the organization of this output instance. Output instances
+// without organizations receive the organization set in their input_org, or
+// the only organization of the input instance.
+func (g *grafanaInstance) receivesOrg(input grafanaInstance) bool {
+	if input.org == nil {
+		return true
+	}
+	if g.org == nil {
+		return g.InputOrg == "" || g.InputOrg == input.orgName()
+	}
+	source := g.org.InputOrg
+	if source == "" {
+		source = g.org.Name
+	}
+	return source == input.orgName()
+}
+
+// inputsFor returns the input instances, per organization, which are uploaded
+// to the organization of an output instance.
+func (cfg *config) inputsFor(output grafanaInstance) ([]grafanaInstance, error) {
+	inputs := []grafanaInstance{}
+	for _, instance := range cfg.Input {
+		orgInstances, err := instance.orgInstances()
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range orgInstances {
+			if output.receivesOrg(i) {
+				inputs = append(inputs, i)
+			}
+		}
+	}
+	return inputs, nil
+}
+
+// validateOrgs checks that instances with several organizations can select
+// them, and that output instances without organizations receive a single
+// organization of each input instance.
+func (cfg *config) validateOrgs() error {
+	for _, instances := range [][]grafanaInstance{cfg.Input, cfg.Output} {
+		for _, instance := range instances {
+			if mode := instance.authMode(); len(instance.Orgs) > 1 && mode != authBasic && mode != authNone {
+				return fmt.Errorf("instance %s: several organizations require basic_auth, %s credentials belong to one", instance.Name, mode)
+			}
+		}
+	}
+	for _, output := range cfg.Output {
+		if len(output.Orgs) > 0 {
+			if output.InputOrg != "" {
+				return fmt.Errorf("instance %s: input_org is set in its organizations", output.Name)
+			}
+			continue
+		}
+		for _, input := range cfg.Input {
+			if len(input.Orgs) > 1 && output.InputOrg == "" {
+				return fmt.Errorf("instance %s: input_org must select one of the organizations of %s", output.Name, input.Name)
+			}
+		}
+	}
+	for _, input := range cfg.Input {
+		if input.InputOrg != "" {
+			return fmt.Errorf("instance %s: input_org is only supported for output instances", input.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceivesOrg(t *testing.T) {
+	main := grafanaInstance{Name: "dev", org: &orgConfig{ID: 1, Name: "Main Org."}}
+	customers := grafanaInstance{Name: "dev", org: &orgConfig{ID: 2, Name: "customers"}}
+
+	output := grafanaInstance{Name: "prod", org: &orgConfig{ID: 4, Name: "customers-prod", InputOrg: "customers"}}
+	require.False(t, output.receivesOrg(main))
+	require.True(t, output.receivesOrg(customers))
+
+	output = grafanaInstance{Name: "prod", InputOrg: "customers"}
+	require.False(t, output.receivesOrg(main))
+	require.True(t, output.receivesOrg(customers))
+	require.True(t, output.receivesOrg(grafanaInstance{Name: "dev"}))
+}
+
+func TestValidateOrgs(t *testing.T) {
+	cfg := &config{
+		Input:  []grafanaInstance{{Name: "dev", Orgs: []orgConfig{{Name: "Main Org."}, {Name: "customers"}}}},
+		Output: []grafanaInstance{{Name: "prod"}},
+	}
+	require.EqualError(t, cfg.validateOrgs(), "instance prod: input_org must select one of the organizations of dev")
+	cfg.Output[0].InputOrg = "customers"
+	require.NoError(t, cfg.validateOrgs())
+
+	cfg.Input[0].ServiceAccountToken = "token"
+	require.EqualError(t, cfg.validateOrgs(), "instance dev: several organizations require basic_auth, service_account credentials belong to one")
+	cfg.Input[0].ServiceAccountToken = ""
+	cfg.Input[0].BasicAuth = &basicAuthConfig{Username: "admin", Password: "admin"}
+	require.NoError(t, cfg.validateOrgs())
+
+	cfg.Input[0].Orgs = cfg.Input[0].Orgs[:1]
+	cfg.Input[0].Exec = &execAuthConfig{Command: []string{"echo", "token"}}
+	cfg.Output[0].InputOrg = ""
+	require.NoError(t, cfg.validateOrgs())
+}
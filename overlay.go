@@ -0,0 +1,297 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Overlays are stored next to the dashboards, as <uid>.<output>.patch.json
+// for JSON patches (RFC 6902) and <uid>.<output>.merge.json for JSON merge
+// patches (RFC 7386). UIDs can not contain dots, so overlays can not be
+// mistaken for dashboards.
+const (
+	patchSuffix = ".patch.json"
+	mergeSuffix = ".merge.json"
+)
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from"`
+	Value interface{} `json:"value"`
+}
+
+func (g *grafanaInstance) overlayPrefix(d *FullDashboard) string {
+	return strings.TrimSuffix(d.path, ".json") + "." + g.Name
+}
+
+// hasOverlays returns true if an output instance has overlays for a dashboard.
+func (g *grafanaInstance) hasOverlays(d *FullDashboard) (bool, error) {
+	if d.path == "" {
+		return false, nil
+	}
+	for _, suffix := range []string{mergeSuffix, patchSuffix} {
+		_, err := os.Stat(g.overlayPrefix(d) + suffix)
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// applyOverlays applies the overlays of an output instance to a dashboard
+// read from the dashboards directory.
+func (g *grafanaInstance) applyOverlays(d *FullDashboard) error {
+	if d.path == "" {
+		return nil
+	}
+	prefix := g.overlayPrefix(d)
+
+	var model interface{} = d.Dashboard.Model
+	var merge interface{}
+	err := readJSON(prefix+mergeSuffix, &merge)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading overlay %s: %w", prefix+mergeSuffix, err)
+	}
+	if err == nil {
+		model = mergePatch(model, merge)
+	}
+
+	var patch []patchOperation
+	err = readJSON(prefix+patchSuffix, &patch)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading overlay %s: %w", prefix+patchSuffix, err)
+	}
+	if err == nil {
+		for i, op := range patch {
+			model, err = applyPatchOperation(model, op)
+			if err != nil {
+				return fmt.Errorf("overlay %s: operation %d (%s %s): %w", prefix+patchSuffix, i, op.Op, op.Path, err)
+			}
+		}
+	}
+
+	m, ok := model.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("overlays of %s for %s do not result in a dashboard", d.path, g.Name)
+	}
+	d.Dashboard.Model = m
+	return nil
+}
+
+// mergePatch applies a JSON merge patch.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// splitPointer splits a JSON pointer in unescaped tokens.
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > length || (i == length && !allowEnd) {
+		return 0, fmt.Errorf("path does not exist: index %s", token)
+	}
+	return i, nil
+}
+
+// getPointer returns the value at a JSON pointer.
+func getPointer(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	v := doc
+	for _, t := range tokens {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			v, ok = c[t]
+			if !ok {
+				return nil, fmt.Errorf("path does not exist: %s", pointer)
+			}
+		case []interface{}:
+			i, err := arrayIndex(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			v = c[i]
+		default:
+			return nil, fmt.Errorf("path does not exist: %s", pointer)
+		}
+	}
+	return v, nil
+}
+
+// updatePointer calls f with the parent of the value at a JSON pointer and
+// the last token, and replaces the parent with the value f returns.
+func updatePointer(doc interface{}, pointer string, f func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("the whole dashboard can not be patched")
+	}
+	var update func(v interface{}, tokens []string) (interface{}, error)
+	update = func(v interface{}, tokens []string) (interface{}, error) {
+		if len(tokens) == 1 {
+			return f(v, tokens[0])
+		}
+		switch c := v.(type) {
+		case map[string]interface{}:
+			child, ok := c[tokens[0]]
+			if !ok {
+				return nil, fmt.Errorf("path does not exist: %s", pointer)
+			}
+			child, err := update(child, tokens[1:])
+			if err != nil {
+				return nil, err
+			}
+			c[tokens[0]] = child
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(tokens[0], len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			child, err := update(c[i], tokens[1:])
+			if err != nil {
+				return nil, err
+			}
+			c[i] = child
+			return c, nil
+		}
+		return nil, fmt.Errorf("path does not exist: %s", pointer)
+	}
+	return update(doc, tokens)
+}
+
+func addPointer(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	return updatePointer(doc, pointer, func(parent interface{}, token string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("path does not exist: %s", pointer)
+	})
+}
+
+func removePointer(doc interface{}, pointer string) (interface{}, error) {
+	return updatePointer(doc, pointer, func(parent interface{}, token string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, fmt.Errorf("path does not exist: %s", pointer)
+			}
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("path does not exist: %s", pointer)
+	})
+}
+
+// applyPatchOperation applies an operation of a JSON patch. Paths which do
+// not exist are errors, so that overlays do not silently stop applying when
+// dashboards change.
+func applyPatchOperation(doc interface{}, op patchOperation) (interface{}, error) {
+	switch op.Op {
+	case "add":
+		return addPointer(doc, op.Path, op.Value)
+	case "remove":
+		return removePointer(doc, op.Path)
+	case "replace":
+		doc, err := removePointer(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		return addPointer(doc, op.Path, op.Value)
+	case "move", "copy":
+		value, err := getPointer(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			doc, err = removePointer(doc, op.From)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return addPointer(doc, op.Path, value)
+	case "test":
+		value, err := getPointer(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, op.Value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown operation %q", op.Op)
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyOverlays(t *testing.T) {
+	dir := t.TempDir()
+
+	folder := filepath.Join(dir, "folder")
+	require.NoError(t, os.Mkdir(folder, 0755))
+	write := func(name, content string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(folder, name), []byte(content), 0644))
+	}
+	write("abc.json", `{"board": {"dashboard": {"uid": "abc", "title": "Nodes", "refresh": "10s",
+		"panels": [{"id": 1, "title": "Debug"}, {"id": 2, "title": "CPU"}]}}}`)
+	write("abc.prod.merge.json", `{"refresh": null, "timezone": "utc"}`)
+	write("abc.prod.patch.json", `[
+		{"op": "test", "path": "/panels/0/title", "value": "Debug"},
+		{"op": "remove", "path": "/panels/0"},
+		{"op": "add", "path": "/panels/-", "value": {"id": 3, "title": "Errors"}}]`)
+
+	// Dashboard files may have dots in their names.
+	write("node.exporter.json", `{"board": {"dashboard": {"uid": "node-exporter"}}}`)
+
+	dashboards, err := readDashboards(dir)
+	require.NoError(t, err)
+	require.Len(t, dashboards, 2)
+
+	prod := grafanaInstance{Name: "prod"}
+	require.NoError(t, prod.applyOverlays(dashboards[0]))
+	require.Equal(t, map[string]interface{}{
+		"uid":      "abc",
+		"title":    "Nodes",
+		"timezone": "utc",
+		"panels": []interface{}{
+			map[string]interface{}{"id": float64(2), "title": "CPU"},
+			map[string]interface{}{"id": float64(3), "title": "Errors"},
+		},
+	}, dashboards[0].Dashboard.Model)
+
+	// The debug panel is not there anymore.
+	require.EqualError(t, prod.applyOverlays(dashboards[0]),
+		"overlay "+filepath.Join(folder, "abc.prod.patch.json")+": operation 0 (test /panels/0/title): test failed")
+	write("abc.prod.patch.json", `[{"op": "remove", "path": "/rows/0"}]`)
+	require.EqualError(t, prod.applyOverlays(dashboards[0]),
+		"overlay "+filepath.Join(folder, "abc.prod.patch.json")+": operation 0 (remove /rows/0): path does not exist: /rows/0")
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// uidClaims lists, per dashboard UID in an output instance, the input
+// instances which have a dashboard with that UID.
+type uidClaims map[string][]grafanaInstance
+
+// dashboardClaims reads the dashboards of the input instances of an output
+// instance, with their UIDs after their overlays and UID mappings. Input
+// instances which were not fetched have no claims.
+func (cfg *config) dashboardClaims(output grafanaInstance, directory string) (uidClaims, error) {
+	claims := make(uidClaims)
+	inputs, err := cfg.inputsFor(output)
+	if err != nil {
+		return nil, err
+	}
+	for _, input := range inputs {
+		dashboards, err := input.dashboards(directory)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading dashboards: %w", err)
+		}
+		for _, d := range dashboards {
+			err = output.prepareDashboard(input, d)
+			if err != nil {
+				return nil, err
+			}
+			if !output.shouldIncludeDashboard(d.Dashboard) {
+				continue
+			}
+			uid, err := getUID(d.Dashboard)
+			if err != nil {
+				return nil, err
+			}
+			claims[uid] = append(claims[uid], input)
+		}
+	}
+	return claims, nil
+}
+
+// isInput returns true if name designates an input instance, by name or, for
+// organizations, as <instance>/<org>.
+func isInput(name string, input grafanaInstance) bool {
+	return name == input.Name || name == instanceKey(input)
+}
+
+// uidOwner returns the input instance which owns a dashboard UID claimed by
+// several input instances: the one in dashboard_owners, else the first one in
+// input_precedence.
+func (g *grafanaInstance) uidOwner(uid string, inputs []grafanaInstance) (grafanaInstance, bool) {
+	if len(inputs) == 1 {
+		return inputs[0], true
+	}
+	if name, ok := g.DashboardOwners[uid]; ok {
+		for _, i := range inputs {
+			if isInput(name, i) {
+				return i, true
+			}
+		}
+	}
+	for _, name := range g.InputPrecedence {
+		for _, i := range inputs {
+			if isInput(name, i) {
+				return i, true
+			}
+		}
+	}
+	return grafanaInstance{}, false
+}
+
+// checkOwner returns an error if a dashboard UID of an output instance is
+// claimed by several input instances and input does not own it.
+func (c uidClaims) checkOwner(output, input grafanaInstance, uid string) error {
+	inputs := c[uid]
+	if len(inputs) < 2 {
+		return nil
+	}
+	owner, ok := output.uidOwner(uid, inputs)
+	if !ok {
+		return fmt.Errorf("dashboard %s collides in %s between %s, set dashboard_owners or input_precedence", uid, instanceKey(output), instanceKeys(inputs))
+	}
+	if instanceKey(owner) != instanceKey(input) {
+		return fmt.Errorf("dashboard %s is owned by %s in %s", uid, instanceKey(owner), instanceKey(output))
+	}
+	return nil
+}
+
+// checkDashboardOwner is checkOwner for a dashboard of input, which is
+// prepared for the output instance to get its UID there.
+func (c uidClaims) checkDashboardOwner(output, input grafanaInstance, d *FullDashboard) error {
+	prepared, err := cloneDashboard(d)
+	if err != nil {
+		return err
+	}
+	err = output.prepareDashboard(input, prepared)
+	if err != nil {
+		return err
+	}
+	uid, err := getUID(prepared.Dashboard)
+	if err != nil {
+		return err
+	}
+	return c.checkOwner(output, input, uid)
+}
+
+// ownerDiff handles, in compare, a dashboard UID of an output instance
+// claimed by several input instances. It returns true if the dashboard of
+// input is not compared, with the collision diff to report if no owner can be
+// decided.
+func (c uidClaims) ownerDiff(output, input grafanaInstance, uid string, diff dashboardDiff) (*dashboardDiff, bool) {
+	inputs := c[uid]
+	if len(inputs) < 2 {
+		return nil, false
+	}
+	owner, ok := output.uidOwner(uid, inputs)
+	if !ok {
+		fmt.Printf("Dashboard %s (%s) collides between %s.\n", diff.Title, uid, instanceKeys(inputs))
+		diff.Action = "collision"
+		diff.Diff = instanceKeys(inputs)
+		return &diff, true
+	}
+	if instanceKey(owner) != instanceKey(input) {
+		fmt.Printf("Dashboard %s (%s) of %s is owned by %s.\n", diff.Title, uid, instanceKey(input), instanceKey(owner))
+		return nil, true
+	}
+	return nil, false
+}
+
+func instanceKeys(instances []grafanaInstance) string {
+	keys := make([]string, 0, len(instances))
+	for _, i := range instances {
+		keys = append(keys, instanceKey(i))
+	}
+	return strings.Join(keys, ", ")
+}
+
+// validateOwners checks that the owners of the output instances are input
+// instances.
+func (cfg *config) validateOwners() error {
+	for _, output := range cfg.Output {
+		names := append([]string{}, output.InputPrecedence...)
+		for _, name := range output.DashboardOwners {
+			names = append(names, name)
+		}
+		for _, name := range names {
+			if cfg.instance(cfg.Input, strings.SplitN(name, "/", 2)[0]) == nil {
+				return fmt.Errorf("instance %s: input instance %q not found", output.Name, name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckOwner(t *testing.T) {
+	platform := grafanaInstance{Name: "platform"}
+	teamA := grafanaInstance{Name: "team-a"}
+	claims := uidClaims{
+		"nodes": {platform, teamA},
+		"pods":  {platform, teamA},
+		"team":  {teamA},
+	}
+
+	output := grafanaInstance{Name: "prod"}
+	require.NoError(t, claims.checkOwner(output, teamA, "team"))
+	require.Error(t, claims.checkOwner(output, teamA, "nodes"))
+
+	output.InputPrecedence = []string{"platform", "team-a"}
+	output.DashboardOwners = map[string]string{"nodes": "team-a"}
+	require.NoError(t, claims.checkOwner(output, teamA, "nodes"))
+	require.Error(t, claims.checkOwner(output, platform, "nodes"))
+	require.NoError(t, claims.checkOwner(output, platform, "pods"))
+	require.Error(t, claims.checkOwner(output, teamA, "pods"))
+}
+
+func TestDashboardClaims(t *testing.T) {
+	dir := t.TempDir()
+	mustWriteDashboard(t, dir, "platform", map[string]interface{}{"uid": "nodes"})
+	mustWriteDashboard(t, dir, "team-a", map[string]interface{}{"uid": "team-nodes"})
+	// The overlay of team-a gives its dashboard the UID of the one of
+	// platform in prod.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "team-a", "general", "team-nodes.prod.merge.json"), []byte(`{"uid": "nodes"}`), 0644))
+
+	cfg := &config{
+		Input:  []grafanaInstance{{Name: "platform"}, {Name: "team-a"}},
+		Output: []grafanaInstance{{Name: "prod"}, {Name: "staging"}},
+	}
+	claims, err := cfg.dashboardClaims(cfg.Output[0], dir)
+	require.NoError(t, err)
+	require.Len(t, claims, 1)
+	require.Equal(t, []string{"platform", "team-a"}, []string{claims["nodes"][0].Name, claims["nodes"][1].Name})
+
+	claims, err = cfg.dashboardClaims(cfg.Output[1], dir)
+	require.NoError(t, err)
+	require.Len(t, claims, 2)
+}
+
+func TestOwnerDiff(t *testing.T) {
+	platform := grafanaInstance{Name: "platform"}
+	teamA := grafanaInstance{Name: "team-a"}
+	claims := uidClaims{
+		"nodes": {platform, teamA},
+		"team":  {teamA},
+	}
+	diff := dashboardDiff{Kind: kindDashboard, Source: "team-a", UID: "nodes", Title: "Nodes"}
+
+	output := grafanaInstance{Name: "prod"}
+	collision, skip := claims.ownerDiff(output, teamA, "team", diff)
+	require.Nil(t, collision)
+	require.False(t, skip)
+
+	collision, skip = claims.ownerDiff(output, teamA, "nodes", diff)
+	require.True(t, skip)
+	require.Equal(t, &dashboardDiff{Kind: kindDashboard, Action: "collision", Source: "team-a", UID: "nodes", Title: "Nodes", Diff: "platform, team-a"}, collision)
+
+	output.InputPrecedence = []string{"platform"}
+	collision, skip = claims.ownerDiff(output, teamA, "nodes", diff)
+	require.Nil(t, collision)
+	require.True(t, skip)
+	collision, skip = claims.ownerDiff(output, platform, "nodes", diff)
+	require.Nil(t, collision)
+	require.False(t, skip)
+}
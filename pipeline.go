@@ -0,0 +1,330 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+const (
+	// gatePreviousStage requires dashboards to be identical in the output
+	// of the previous stage. It is always enforced for stages whose source
+	// is another stage.
+	gatePreviousStage = "previous_stage"
+	// gateDatasources requires all the datasources of dashboards to exist in
+	// the output of the stage.
+	gateDatasources = "datasources"
+)
+
+// stageConfig is a stage of the promotion pipeline. Its source is either an
+// input instance or a previous stage. Dashboards are always uploaded from the
+// fetched files of the input instance at the start of the pipeline.
+type stageConfig struct {
+	Name           string   `yaml:"name"`
+	Source         string   `yaml:"source"`
+	Output         string   `yaml:"output"`
+	IncludeTags    []string `yaml:"include_tags"`
+	IncludeFolders []string `yaml:"include_folders"`
+	Gates          []string `yaml:"gates"`
+}
+
+// outputName returns the name of the output instance of the stage, which
+// defaults to the name of the stage.
+func (s *stageConfig) outputName() string {
+	if s.Output != "" {
+		return s.Output
+	}
+	return s.Name
+}
+
+func (s *stageConfig) hasGate(gate string) bool {
+	for _, g := range s.Gates {
+		if g == gate {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns an error if the dashboard can not go through the stage
+// because of its tags or folder.
+func (s *stageConfig) allows(d *FullDashboard) error {
+	if len(s.IncludeTags) > 0 {
+		stage := grafanaInstance{IncludeTags: s.IncludeTags}
+		if !stage.shouldIncludeDashboard(d.Dashboard) {
+			return fmt.Errorf("tags %s are not allowed in stage %s", strings.Join(getTags(d.Dashboard), ", "), s.Name)
+		}
+	}
+	if len(s.IncludeFolders) > 0 {
+		var title string
+		if d.Folder != nil {
+			title = d.Folder.Title
+		}
+		for _, f := range s.IncludeFolders {
+			if f == title {
+				return nil
+			}
+		}
+		return fmt.Errorf("folder %q is not allowed in stage %s", title, s.Name)
+	}
+	return nil
+}
+
+func (cfg *config) stage(name string) *stageConfig {
+	for i := range cfg.Pipeline {
+		if cfg.Pipeline[i].Name == name {
+			return &cfg.Pipeline[i]
+		}
+	}
+	return nil
+}
+
+func (cfg *config) instance(instances []grafanaInstance, name string) *grafanaInstance {
+	for i := range instances {
+		if instances[i].Name == name {
+			return &instances[i]
+		}
+	}
+	return nil
+}
+
+// validatePipeline checks that the sources of the stages are input instances
+// or previous stages, without cycles, and that their outputs are output
+// instances.
+func (cfg *config) validatePipeline() error {
+	seen := make(map[string]bool)
+	for _, s := range cfg.Pipeline {
+		if s.Name == "" {
+			return fmt.Errorf("pipeline stage without name")
+		}
+		if seen[s.Name] {
+			return fmt.Errorf("pipeline stage %s: duplicate name", s.Name)
+		}
+		if !seen[s.Source] && cfg.instance(cfg.Input, s.Source) == nil {
+			return fmt.Errorf("pipeline stage %s: source %q is neither an input instance nor a previous stage", s.Name, s.Source)
+		}
+		if cfg.instance(cfg.Output, s.outputName()) == nil {
+			return fmt.Errorf("pipeline stage %s: output instance %q not found", s.Name, s.outputName())
+		}
+		for _, g := range s.Gates {
+			if g != gatePreviousStage && g != gateDatasources {
+				return fmt.Errorf("pipeline stage %s: unknown gate %q", s.Name, g)
+			}
+		}
+		seen[s.Name] = true
+	}
+
+	// Stages are looked up before input instances, so a stage named after
+	// its source input instance is its own source, which is a cycle too.
+	for i := range cfg.Pipeline {
+		visited := make(map[string]bool)
+		for s := &cfg.Pipeline[i]; s != nil; s = cfg.stage(s.Source) {
+			if visited[s.Name] {
+				return fmt.Errorf("pipeline stage %s: its sources form a cycle", cfg.Pipeline[i].Name)
+			}
+			visited[s.Name] = true
+		}
+	}
+	return nil
+}
+
+// stageSource returns the input instance at the start of the pipeline of a
+// stage, and the previous stage, if any.
+func (cfg *config) stageSource(s *stageConfig) (*grafanaInstance, *stageConfig) {
+	previous := cfg.stage(s.Source)
+	if previous == nil {
+		return cfg.instance(cfg.Input, s.Source), nil
+	}
+	input, _ := cfg.stageSource(previous)
+	return input, previous
+}
+
+// cloneDashboard returns a deep copy of a dashboard, so that its datasources
+// can be changed for several instances.
+func cloneDashboard(d *FullDashboard) (*FullDashboard, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	clone := &FullDashboard{path: d.path}
+	err = json.Unmarshal(data, clone)
+	return clone, err
+}
+
+// promoteDashboards uploads dashboards to the output of a stage, after
+// checking that they went through all the previous stages.
+func promoteDashboards(cfg *config) error {
+	err := validatePrefer(*promotePrefer)
+	if err != nil {
+		return err
+	}
+	s := cfg.stage(*promoteTo)
+	if s == nil {
+		return fmt.Errorf("pipeline stage %s not found", *promoteTo)
+	}
+	input, _ := cfg.stageSource(s)
+	inputInstance, err := input.orgInstance("")
+	if err != nil {
+		return err
+	}
+	dashboards, err := inputInstance.dashboards(*promoteDirectory)
+	if err != nil {
+		return err
+	}
+
+	outputInstance, err := cfg.stageOutput(s, inputInstance)
+	if err != nil {
+		return err
+	}
+	client, err := outputInstance.client()
+	if err != nil {
+		return err
+	}
+	clientDS := clientDatasources(client)
+
+	claims, err := cfg.dashboardClaims(outputInstance, *promoteDirectory)
+	if err != nil {
+		return err
+	}
+	promoted := []*FullDashboard{}
+	for _, dashboardUID := range *promoteDashboardsList {
+		dashboard, err := findDashboard(dashboards, dashboardUID)
+		if err != nil {
+			return err
+		}
+		err = claims.checkDashboardOwner(outputInstance, inputInstance, dashboard)
+		if err != nil {
+			return err
+		}
+		err = cfg.checkStages(s, inputInstance, dashboard, clientDS)
+		if err != nil {
+			return fmt.Errorf("dashboard %s can not be promoted to %s: %w", dashboardUID, s.Name, err)
+		}
+		promoted = append(promoted, dashboard)
+	}
+
+	state, err := loadState(cfg.StateFile)
+	if err != nil {
+		return err
+	}
+	for _, dashboard := range promoted {
+		err = state.uploadDashboard(inputInstance, outputInstance, client, clientDS, dashboard, uploadOptions{force: *promoteForce, prefer: *promotePrefer})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkStages checks that a dashboard of the input instance of a stage is
+// allowed in the stage and its previous stages, and that it passed the
+// previous stage.
+func (cfg *config) checkStages(s *stageConfig, input grafanaInstance, dashboard *FullDashboard, clientDS []*gapi.DataSource) error {
+	err := s.allows(dashboard)
+	if err != nil {
+		return err
+	}
+
+	if s.hasGate(gateDatasources) {
+		equiv := datasourcesEquivalence(dashboard.Datasources, clientDS)
+		for _, ds := range dashboard.Datasources {
+			if _, ok := equiv[ds.UID]; !ok {
+				return fmt.Errorf("datasource %s (%s) not found in stage %s", ds.Name, ds.Type, s.Name)
+			}
+		}
+	}
+
+	_, previous := cfg.stageSource(s)
+	if previous == nil {
+		return nil
+	}
+	var previousDS []*gapi.DataSource
+	if previous.hasGate(gateDatasources) {
+		previousDS, err = cfg.stageDatasources(previous, input)
+		if err != nil {
+			return err
+		}
+	}
+	err = cfg.checkStages(previous, input, dashboard, previousDS)
+	if err != nil {
+		return err
+	}
+	return cfg.checkPassed(previous, input, dashboard)
+}
+
+// stageOutput returns the output instance of a stage, for the organization
+// the input instance is promoted to.
+func (cfg *config) stageOutput(s *stageConfig, input grafanaInstance) (grafanaInstance, error) {
+	return cfg.instance(cfg.Output, s.outputName()).outputOrgInstance("", input)
+}
+
+// stageDatasources returns the datasources of the output of a stage.
+func (cfg *config) stageDatasources(s *stageConfig, input grafanaInstance) ([]*gapi.DataSource, error) {
+	outputInstance, err := cfg.stageOutput(s, input)
+	if err != nil {
+		return nil, err
+	}
+	client, err := outputInstance.client()
+	if err != nil {
+		return nil, err
+	}
+	return clientDatasources(client), nil
+}
+
+// checkPassed checks that a dashboard is up to date in the output of a stage.
+func (cfg *config) checkPassed(s *stageConfig, input grafanaInstance, dashboard *FullDashboard) error {
+	outputInstance, err := cfg.stageOutput(s, input)
+	if err != nil {
+		return err
+	}
+	client, err := outputInstance.client()
+	if err != nil {
+		return err
+	}
+	local, err := cloneDashboard(dashboard)
+	if err != nil {
+		return err
+	}
+	err = outputInstance.prepareDashboard(input, local)
+	if err != nil {
+		return err
+	}
+	uid, err := getUID(local.Dashboard)
+	if err != nil {
+		return err
+	}
+	clientDS := clientDatasources(client)
+	changeDatasources(local.Dashboard, local.Datasources, clientDS)
+	for _, p := range local.LibraryPanels {
+		changeLibraryPanelDatasources(p, local.Datasources, clientDS)
+	}
+	if outputInstance.ReadOnly {
+		makeReadOnly(local.Dashboard)
+	}
+
+	output, err := fetchOutputDashboard(client, uid, local)
+	if isNotFound(err) {
+		return fmt.Errorf("not promoted to stage %s yet", s.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if !equalDashboards(*local, output) {
+		return fmt.Errorf("stage %s has a different version", s.Name)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePipeline(t *testing.T) {
+	cfg := &config{
+		Input:  []grafanaInstance{{Name: "dev"}},
+		Output: []grafanaInstance{{Name: "staging"}, {Name: "production"}},
+		Pipeline: []stageConfig{
+			{Name: "staging", Source: "dev"},
+			{Name: "prod", Source: "staging", Output: "production"},
+		},
+	}
+	require.NoError(t, cfg.validatePipeline())
+
+	input, previous := cfg.stageSource(cfg.stage("prod"))
+	require.Equal(t, "dev", input.Name)
+	require.Equal(t, "staging", previous.Name)
+
+	cfg.Pipeline[0], cfg.Pipeline[1] = cfg.Pipeline[1], cfg.Pipeline[0]
+	require.EqualError(t, cfg.validatePipeline(), `pipeline stage prod: source "staging" is neither an input instance nor a previous stage`)
+
+	cfg.Pipeline = []stageConfig{{Name: "dev", Source: "dev", Output: "staging"}}
+	require.EqualError(t, cfg.validatePipeline(), "pipeline stage dev: its sources form a cycle")
+
+	cfg.Input = append(cfg.Input, grafanaInstance{Name: "staging"})
+	cfg.Pipeline = []stageConfig{
+		{Name: "dev", Source: "staging", Output: "staging"},
+		{Name: "staging", Source: "dev"},
+	}
+	require.EqualError(t, cfg.validatePipeline(), "pipeline stage dev: its sources form a cycle")
+}
+
+func TestCheckPassedReadOnly(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/dashboards/uid/nodes":
+			_, _ = w.Write([]byte(`{"dashboard": {"uid": "nodes", "title": "Nodes", "editable": false, "version": 2}, "meta": {"folderId": 0}}`))
+		case "/api/folders/id/0":
+			_, _ = w.Write([]byte(`{"id": 0, "title": "General"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &config{
+		Input:    []grafanaInstance{{Name: "dev"}},
+		Output:   []grafanaInstance{{Name: "staging", URL: server.URL, ReadOnly: true}},
+		Pipeline: []stageConfig{{Name: "staging", Source: "dev"}},
+	}
+	dashboard := &FullDashboard{
+		Dashboard: &gapi.Dashboard{Model: mustModel(t, `{"uid": "nodes", "title": "Nodes"}`)},
+		Folder:    &gapi.Folder{Title: "General"},
+	}
+	require.NoError(t, cfg.checkPassed(cfg.stage("staging"), cfg.Input[0], dashboard))
+
+	cfg.Output[0].ReadOnly = false
+	require.EqualError(t, cfg.checkPassed(cfg.stage("staging"), cfg.Input[0], dashboard), "stage staging has a different version")
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+const (
+	permissionView = 1
+	permissionEdit = 2
+)
+
+// permission is an item of the permissions of a folder or a dashboard.
+type permission struct {
+	Role       string
+	UserID     int64
+	TeamID     int64
+	Permission int64
+}
+
+// principal returns the ID of the user, or service account, that
+// dashboard-manager authenticates as in an instance, or 0 for API keys, which
+// permissions can not be granted to.
+func (g *grafanaInstance) principal() (int64, error) {
+	api, err := g.api()
+	if err != nil {
+		return 0, err
+	}
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	err = api.request("GET", "/api/user", nil, &user)
+	// API keys are not users.
+	if isUnauthorized(err) || isForbidden(err) || isNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading the user of %s: %w", instanceKey(*g), err)
+	}
+	return user.ID, nil
+}
+
+// readOnlyPermissions restricts the permissions of the folders of read-only
+// output instances, and of their dashboards in the General folder: roles,
+// teams and users keep at most the view permission, and only the principal of
+// dashboard-manager can edit. Admins can always edit.
+func readOnlyPermissions(existing []permission, principal int64) *gapi.PermissionItems {
+	items := &gapi.PermissionItems{}
+	roles := make(map[string]bool)
+	for _, p := range existing {
+		if principal != 0 && p.UserID == principal {
+			continue
+		}
+		if p.Permission > permissionView {
+			p.Permission = permissionView
+		}
+		if p.Role != "" {
+			roles[p.Role] = true
+		}
+		items.Items = append(items.Items, &gapi.PermissionItem{Role: p.Role, TeamID: p.TeamID, UserID: p.UserID, Permission: p.Permission})
+	}
+	for _, role := range []string{"Viewer", "Editor"} {
+		if !roles[role] {
+			items.Items = append(items.Items, &gapi.PermissionItem{Role: role, Permission: permissionView})
+		}
+	}
+	if principal != 0 {
+		items.Items = append(items.Items, &gapi.PermissionItem{UserID: principal, Permission: permissionEdit})
+	}
+	return items
+}
+
+// makeReadOnly prevents users from saving changes to a dashboard.
+func makeReadOnly(b *gapi.Dashboard) {
+	b.Model["editable"] = false
+}
+
+// currentPermissions returns the permissions of a folder, or of a dashboard
+// in the General folder, without the inherited ones.
+func currentPermissions(client *gapi.Client, folderID, dashboardID int64) ([]permission, error) {
+	permissions := []permission{}
+	if folderID == 0 {
+		items, err := client.DashboardPermissions(dashboardID)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range items {
+			if !p.Inherited {
+				permissions = append(permissions, permission{p.Role, p.UserID, p.TeamID, p.Permission})
+			}
+		}
+		return permissions, nil
+	}
+	folder, err := client.Folder(folderID)
+	if err != nil {
+		return nil, err
+	}
+	items, err := client.FolderPermissions(folder.UID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range items {
+		permissions = append(permissions, permission{p.Role, p.UserID, p.TeamID, p.Permission})
+	}
+	return permissions, nil
+}
+
+// protectDashboard restricts the permissions of the folder of a dashboard, or
+// of the dashboard itself if it is in the General folder, keeping the other
+// grants as view permissions.
+func protectDashboard(client *gapi.Client, principal, folderID, dashboardID int64) error {
+	existing, err := currentPermissions(client, folderID, dashboardID)
+	if err != nil {
+		return err
+	}
+	if folderID == 0 {
+		return client.UpdateDashboardPermissions(dashboardID, readOnlyPermissions(existing, principal))
+	}
+	folder, err := client.Folder(folderID)
+	if err != nil {
+		return err
+	}
+	return client.UpdateFolderPermissions(folder.UID, readOnlyPermissions(existing, principal))
+}
+
+// checkProtection returns why a dashboard of a read-only output instance is
+// not protected anymore, or an empty string.
+func checkProtection(client *gapi.Client, principal int64, board *gapi.Dashboard) (string, error) {
+	if editable, ok := board.Model["editable"].(bool); !ok || editable {
+		return "dashboard is editable", nil
+	}
+	id, _ := board.Model["id"].(float64)
+	permissions, err := currentPermissions(client, board.Meta.Folder, int64(id))
+	if err != nil {
+		return "", err
+	}
+	return permissionsProblem(permissions, principal), nil
+}
+
+// permissionsProblem returns which role, user or team other than the
+// principal of dashboard-manager can edit, or an empty string.
+func permissionsProblem(permissions []permission, principal int64) string {
+	for _, p := range permissions {
+		if p.Permission <= permissionView || (principal != 0 && p.UserID == principal) {
+			continue
+		}
+		switch {
+		case p.Role != "":
+			return fmt.Sprintf("role %s can edit", p.Role)
+		case p.UserID != 0:
+			return fmt.Sprintf("user %d can edit", p.UserID)
+		case p.TeamID != 0:
+			return fmt.Sprintf("team %d can edit", p.TeamID)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyPermissions(t *testing.T) {
+	existing := []permission{
+		{Role: "Editor", Permission: permissionEdit},
+		{TeamID: 3, Permission: 4},
+		{UserID: 5, Permission: permissionView},
+		{UserID: 7, Permission: permissionEdit},
+	}
+	require.Equal(t, "role Editor can edit", permissionsProblem(existing, 7))
+
+	items := readOnlyPermissions(existing, 7)
+	require.Equal(t, []*gapi.PermissionItem{
+		{Role: "Editor", Permission: permissionView},
+		{TeamID: 3, Permission: permissionView},
+		{UserID: 5, Permission: permissionView},
+		{Role: "Viewer", Permission: permissionView},
+		{UserID: 7, Permission: permissionEdit},
+	}, items.Items)
+
+	protected := []permission{}
+	for _, i := range items.Items {
+		protected = append(protected, permission{i.Role, i.UserID, i.TeamID, i.Permission})
+	}
+	require.Empty(t, permissionsProblem(protected, 7))
+	require.Equal(t, "user 7 can edit", permissionsProblem(protected, 0))
+	require.Equal(t, "role Admin can edit", permissionsProblem([]permission{{Role: "Admin", Permission: permissionEdit}}, 7))
+}
+
+func TestPrincipal(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"id": 7}`))
+	}))
+	defer server.Close()
+	g := &grafanaInstance{Name: "prod", URL: server.URL}
+
+	principal, err := g.principal()
+	require.NoError(t, err)
+	require.Equal(t, int64(7), principal)
+
+	for _, status = range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		principal, err = g.principal()
+		require.NoError(t, err)
+		require.Zero(t, principal)
+	}
+
+	status = http.StatusInternalServerError
+	_, err = g.principal()
+	require.Error(t, err)
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// provenanceMessage describes where an uploaded dashboard comes from. It is
+// the version message of the dashboard in the output instance.
+func provenanceMessage(r *promotionRecord) string {
+	parts := []string{fmt.Sprintf("%s version %d", r.Source, r.SourceVersion)}
+	if r.GitCommit != "" {
+		parts = append(parts, "commit "+r.GitCommit)
+	}
+	if r.PipelineID != "" {
+		parts = append(parts, "pipeline "+r.PipelineID)
+	}
+	parts = append(parts, "by "+r.Actor)
+	return "dashboard-manager: " + strings.Join(parts, ", ")
+}
+
+// provenanceTag is the tag of the provenance links, which are removed before
+// comparing dashboards. Other links, even tagged with the managed tag, are
+// kept.
+const provenanceTag = "dashboard-manager-provenance"
+
+// addProvenance adds a link to the source dashboard, with its UID in the input
+// instance, which describes where the dashboard comes from. Input instances
+// without URL, which evaluate jsonnet, have no source dashboard to link to.
+func addProvenance(b *gapi.Dashboard, input grafanaInstance, uid string, r *promotionRecord) {
+	if input.URL == "" {
+		return
+	}
+	links, _ := b.Model["links"].([]interface{})
+	b.Model["links"] = append(links, map[string]interface{}{
+		"title":       fmt.Sprintf("Source: %s version %d", r.Source, r.SourceVersion),
+		"tooltip":     provenanceMessage(r),
+		"type":        "link",
+		"icon":        "info",
+		"url":         strings.TrimSuffix(input.URL, "/") + "/d/" + uid,
+		"targetBlank": true,
+		"tags":        []interface{}{provenanceTag},
+	})
+}
+
+// removeProvenance removes the provenance link of a dashboard.
+func removeProvenance(b *gapi.Dashboard) {
+	links, ok := b.Model["links"].([]interface{})
+	if !ok {
+		return
+	}
+	kept := []interface{}{}
+	for _, l := range links {
+		if link, ok := l.(map[string]interface{}); ok && isProvenanceLink(link) {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	b.Model["links"] = kept
+}
+
+func isProvenanceLink(link map[string]interface{}) bool {
+	tags, _ := link["tags"].([]interface{})
+	for _, t := range tags {
+		if t == provenanceTag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvenanceMessage(t *testing.T) {
+	r := &promotionRecord{Source: "dev", SourceVersion: 12, Actor: "ci"}
+	require.Equal(t, "dashboard-manager: dev version 12, by ci", provenanceMessage(r))
+	r.GitCommit, r.PipelineID = "3f2a1c9", "1234"
+	require.Equal(t, "dashboard-manager: dev version 12, commit 3f2a1c9, pipeline 1234, by ci", provenanceMessage(r))
+}
+
+func TestProvenanceLink(t *testing.T) {
+	managedLink := map[string]interface{}{"type": "dashboards", "tags": []interface{}{managedTag}}
+	b := &gapi.Dashboard{Model: map[string]interface{}{
+		"uid":   "a-nodes",
+		"links": []interface{}{managedLink},
+	}}
+	r := &promotionRecord{Source: "dev", SourceVersion: 12, Actor: "ci"}
+
+	addProvenance(b, grafanaInstance{Name: "dev", URL: "https://dev.example.com/"}, "nodes", r)
+	links := b.Model["links"].([]interface{})
+	require.Len(t, links, 2)
+	require.Equal(t, map[string]interface{}{
+		"title":       "Source: dev version 12",
+		"tooltip":     "dashboard-manager: dev version 12, by ci",
+		"type":        "link",
+		"icon":        "info",
+		"url":         "https://dev.example.com/d/nodes",
+		"targetBlank": true,
+		"tags":        []interface{}{provenanceTag},
+	}, links[1])
+
+	removeProvenance(b)
+	require.Equal(t, []interface{}{managedLink}, b.Model["links"])
+
+	addProvenance(b, grafanaInstance{Name: "jsonnet"}, "nodes", r)
+	require.Equal(t, []interface{}{managedLink}, b.Model["links"])
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// ageTag is the YAML tag of the values encrypted with age, e.g. the output
+// of `age --encrypt --armor --recipient <recipient>`.
+const ageTag = "!age"
+
+// ageDecrypter decrypts the values of the configuration file. The identity
+// file is only read when an encrypted value is found.
+type ageDecrypter struct {
+	identityFile string
+	identities   []age.Identity
+}
+
+func (d *ageDecrypter) decrypt(value, path string) (string, error) {
+	if d.identities == nil {
+		if d.identityFile == "" {
+			return "", fmt.Errorf("%s: value is encrypted but no age identity file is set", path)
+		}
+		f, err := os.Open(d.identityFile)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		d.identities, err = age.ParseIdentities(f)
+		if err != nil {
+			return "", fmt.Errorf("error reading age identity file %s: %w", d.identityFile, err)
+		}
+	}
+
+	r := strings.NewReader(strings.TrimSpace(value))
+	decrypted, err := age.Decrypt(armor.NewReader(r), d.identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return "", fmt.Errorf("%s: value is not encrypted for the age identity", path)
+		}
+		return "", fmt.Errorf("%s: error decrypting value: %w", path, err)
+	}
+	data, err := ioutil.ReadAll(decrypted)
+	if err != nil {
+		return "", fmt.Errorf("%s: error decrypting value: %w", path, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
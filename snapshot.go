@@ -13,12 +13,8 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/fs"
-	"io/ioutil"
-	"path/filepath"
 
 	gapi "github.com/grafana/grafana-api-golang-client"
 )
@@ -51,62 +47,37 @@ func snapshotDashboards(cfg *config) error {
 		return errors.New("input instance not found")
 	}
 
-	client, err := outputInstance.client()
+	inputInstance, err := inputInstance.orgInstance(*snapshotSourceOrg)
+	if err != nil {
+		return err
+	}
+	outputInstance, err = outputInstance.outputOrgInstance(*snapshotOutputOrg, inputInstance)
 	if err != nil {
 		return err
 	}
 
-	basepath := filepath.Join(*snapshotDirectory, inputInstance.Name)
-	dashboards := []*FullDashboard{}
-	err = filepath.Walk(basepath, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		data, err := ioutil.ReadFile(path)
-		if err != nil {
-			return err
-		}
-		localDashboard := &FullDashboard{}
-		err = json.Unmarshal(data, localDashboard)
-		if err != nil {
-			return err
-		}
-		dashboards = append(dashboards, localDashboard)
-		return nil
-	})
+	client, err := outputInstance.client()
 	if err != nil {
 		return err
 	}
 
-	clientDS := []*gapi.DataSource{}
-	// Hard code limit to 50 for now.
-	for i := int64(0); i < 50; i++ {
-		ds, err := client.DataSource(i)
-		if err == nil {
-			clientDS = append(clientDS, ds)
-		}
+	dashboards, err := inputInstance.dashboards(*snapshotDirectory)
+	if err != nil {
+		return err
 	}
 
+	clientDS := clientDatasources(client)
+
 	for _, dashboardUID := range *snapshotDashboardsList {
-		var dashboard FullDashboard
-		var found bool
-		for _, d := range dashboards {
-			uid, err := getUID(d.Dashboard)
-			if err != nil {
-				return err
-			}
-			if uid == dashboardUID {
-				dashboard = *d
-				found = true
-			}
-		}
-		if !found {
-			return fmt.Errorf("dasboard %s not found", dashboardUID)
+		dashboard, err := findDashboard(dashboards, dashboardUID)
+		if err != nil {
+			return err
 		}
 
+		err = outputInstance.prepareDashboard(inputInstance, dashboard)
+		if err != nil {
+			return err
+		}
 		changeDatasources(dashboard.Dashboard, dashboard.Datasources, clientDS)
 
 		resp, err := client.NewSnapshot(gapi.Snapshot{
@@ -0,0 +1,399 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+const (
+	statusNotPromoted = "not promoted"
+	statusCurrent     = "current"
+	statusBehind      = "behind"
+	statusDrifted     = "drifted"
+)
+
+// promotionRecord is the last upload of a dashboard to an output instance.
+type promotionRecord struct {
+	Source        string    `json:"source"`
+	SourceVersion int64     `json:"source_version"`
+	Hash          string    `json:"hash"`
+	OutputVersion int64     `json:"output_version"`
+	Timestamp     time.Time `json:"timestamp"`
+	Actor         string    `json:"actor"`
+	GitCommit     string    `json:"git_commit,omitempty"`
+	PipelineID    string    `json:"pipeline_id,omitempty"`
+	// Base is the dashboard model as uploaded.
+	Base map[string]interface{} `json:"base,omitempty"`
+}
+
+// promotionState records the uploads of dashboards, by UID, per output
+// instance key. It is kept in the state file of the configuration, which can
+// be committed with the fetched dashboards.
+type promotionState struct {
+	path    string
+	Outputs map[string]map[string]*promotionRecord `json:"outputs"`
+}
+
+// loadState reads the state file. A missing file is an empty state, and an
+// empty path a state which is never saved, without which dashboards changed
+// in output instances can not be detected.
+func loadState(path string) (*promotionState, error) {
+	state := &promotionState{path: path, Outputs: make(map[string]map[string]*promotionRecord)}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "Warning: state_file is not configured, dashboards changed in output instances since they were uploaded are overwritten.")
+		return state, nil
+	}
+	err := readJSON(path, state)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %w", err)
+	}
+	return state, nil
+}
+
+func (s *promotionState) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return writeJSON(s.path, s)
+}
+
+func (s *promotionState) get(output grafanaInstance, uid string) *promotionRecord {
+	return s.Outputs[instanceKey(output)][uid]
+}
+
+// record saves the upload of a dashboard to an output instance.
+func (s *promotionState) record(output grafanaInstance, uid string, r *promotionRecord) error {
+	key := instanceKey(output)
+	if s.Outputs[key] == nil {
+		s.Outputs[key] = make(map[string]*promotionRecord)
+	}
+	s.Outputs[key][uid] = r
+	return s.save()
+}
+
+// drifted returns true if the dashboard of an output instance changed since
+// it was uploaded.
+func (s *promotionState) drifted(output grafanaInstance, uid string, board *gapi.Dashboard) bool {
+	r := s.get(output, uid)
+	return r != nil && dashboardVersion(board) != r.OutputVersion
+}
+
+// uploadOptions are the options of the upload of dashboards changed in the
+// output instance since they were uploaded.
+type uploadOptions struct {
+	// force overwrites them.
+	force bool
+	// prefer resolves the conflicts of their merge, see mergeResolver.
+	prefer []string
+}
+
+// uploadDashboard uploads a dashboard of an input instance to an output
+// instance, stamped as managed, and records it. Dashboards which are neither
+// stamped nor recorded are never overwritten. Drifted dashboards are merged
+// with the changes made in the output instance, or overwritten with force.
+func (s *promotionState) uploadDashboard(input, output grafanaInstance, client *gapi.Client, clientDS []*gapi.DataSource, dashboard *FullDashboard, opts uploadOptions) error {
+	r, err := newPromotionRecord(input, dashboard)
+	if err != nil {
+		return err
+	}
+	sourceUID, err := getUID(dashboard.Dashboard)
+	if err != nil {
+		return err
+	}
+	err = output.prepareDashboard(input, dashboard)
+	if err != nil {
+		return err
+	}
+	uid, err := getUID(dashboard.Dashboard)
+	if err != nil {
+		return err
+	}
+
+	var previous *gapi.Dashboard
+	board, err := client.DashboardByUID(uid)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if err == nil {
+		previous = board
+		if !isManaged(getTags(board)) && s.get(output, uid) == nil {
+			return unmanagedError(output, uid)
+		}
+		if !opts.force && s.drifted(output, uid, board) {
+			unstampDashboard(board)
+			dashboard, err = s.mergeDashboard(output, uid, clientDS, dashboard, board, opts.prefer)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	stampDashboard(dashboard.Dashboard)
+	dashboard.Dashboard.Message = provenanceMessage(r)
+	if output.Provenance {
+		addProvenance(dashboard.Dashboard, input, sourceUID, r)
+	}
+	if output.ReadOnly {
+		makeReadOnly(dashboard.Dashboard)
+	}
+	resp, err := uploadDashboard(client, clientDS, *dashboard)
+	if err != nil {
+		return err
+	}
+	if output.ReadOnly {
+		principal, err := output.principal()
+		if err != nil {
+			return err
+		}
+		err = protectDashboard(client, principal, dashboard.Dashboard.Folder, resp.ID)
+		if err != nil {
+			return fmt.Errorf("error protecting %s: %w", uid, err)
+		}
+	}
+	r.OutputVersion = resp.Version
+	r.Base, err = baseModel(dashboard.Dashboard.Model)
+	if err != nil {
+		return err
+	}
+	unstampDashboard(&gapi.Dashboard{Model: r.Base})
+	err = s.record(output, resp.UID, r)
+	if err != nil {
+		return err
+	}
+
+	if output.Annotations != nil {
+		err = annotateUpload(client, output.Annotations, r, resp.ID, uid, previous, dashboard.Dashboard)
+		if err != nil {
+			return fmt.Errorf("error annotating upload of %s: %w", uid, err)
+		}
+	}
+	return nil
+}
+
+// mergeDashboard merges a dashboard with the changes made in the output
+// instance since it was uploaded. The merged dashboard uses the datasources
+// of the output instance.
+func (s *promotionState) mergeDashboard(output grafanaInstance, uid string, clientDS []*gapi.DataSource, dashboard *FullDashboard, board *gapi.Dashboard, prefer []string) (*FullDashboard, error) {
+	r := s.get(output, uid)
+	if r.Base == nil {
+		return nil, fmt.Errorf("dashboard %s was changed in %s since it was uploaded, use --force to overwrite it", uid, instanceKey(output))
+	}
+
+	local, err := cloneDashboard(dashboard)
+	if err != nil {
+		return nil, err
+	}
+	changeDatasources(local.Dashboard, local.Datasources, clientDS)
+	for _, p := range local.LibraryPanels {
+		changeLibraryPanelDatasources(p, local.Datasources, clientDS)
+	}
+
+	merged, conflicts, err := mergeDashboards(r.Base, local.Dashboard.Model, board.Model, mergeResolver{uid: uid, prefer: prefer})
+	if err != nil {
+		return nil, err
+	}
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("dashboard %s was changed in %s since it was uploaded, and can not be merged: conflicts at %s, use --prefer or --force", uid, instanceKey(output), strings.Join(conflicts, ", "))
+	}
+	fmt.Printf("Dashboard %s merged with the changes made in %s.\n", uid, instanceKey(output))
+
+	local.Dashboard.Model = merged
+	// The datasources are already the ones of the output instance.
+	local.Datasources = dashboardDatasources(clientDS, getAllDatasources(local.Dashboard, local.LibraryPanels))
+	return local, nil
+}
+
+// baseModel returns a copy of a dashboard model as uploaded, which is the
+// base of the next merges.
+func baseModel(model map[string]interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	base := make(map[string]interface{})
+	err = json.Unmarshal(data, &base)
+	if err != nil {
+		return nil, err
+	}
+	delete(base, "id")
+	delete(base, "version")
+	delete(base, "iteration")
+	return base, nil
+}
+
+// instanceKey identifies an instance, or one of its organizations, e.g. prod
+// or prod/main.
+func instanceKey(g grafanaInstance) string {
+	return path.Join(g.Name, g.orgName())
+}
+
+// newPromotionRecord returns the record of a dashboard of an input instance.
+// It must be called before the datasources of the dashboard are changed.
+func newPromotionRecord(input grafanaInstance, d *FullDashboard) (*promotionRecord, error) {
+	hash, err := dashboardHash(d.Dashboard)
+	if err != nil {
+		return nil, err
+	}
+	return &promotionRecord{
+		Source:        instanceKey(input),
+		SourceVersion: dashboardVersion(d.Dashboard),
+		Hash:          hash,
+		Timestamp:     time.Now().UTC(),
+		Actor:         actor(),
+		GitCommit:     *gitCommit,
+		PipelineID:    *pipelineID,
+	}, nil
+}
+
+// dashboardHash returns the hash of the content of a dashboard, ignoring the
+// fields which change with every save.
+func dashboardHash(d *gapi.Dashboard) (string, error) {
+	model := make(map[string]interface{}, len(d.Model))
+	for k, v := range d.Model {
+		model[k] = v
+	}
+	delete(model, "id")
+	delete(model, "version")
+	delete(model, "iteration")
+	data, err := json.Marshal(model)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func dashboardVersion(d *gapi.Dashboard) int64 {
+	if v, ok := d.Model["version"].(float64); ok {
+		return int64(v)
+	}
+	return 0
+}
+
+// actor returns who runs dashboard-manager, from DASHBOARD_MANAGER_ACTOR or
+// the current user.
+func actor() string {
+	if a := os.Getenv("DASHBOARD_MANAGER_ACTOR"); a != "" {
+		return a
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// dashboardStatus returns the status of a dashboard of an input instance in
+// an output instance.
+func dashboardStatus(client *gapi.Client, r *promotionRecord, local *FullDashboard, uid string) (string, error) {
+	if r == nil {
+		return statusNotPromoted, nil
+	}
+	output, err := client.DashboardByUID(uid)
+	// Dashboards deleted from the output instance are uploaded again as new
+	// dashboards.
+	if isNotFound(err) {
+		return statusNotPromoted, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if dashboardVersion(output) != r.OutputVersion {
+		return statusDrifted, nil
+	}
+	hash, err := dashboardHash(local.Dashboard)
+	if err != nil {
+		return "", err
+	}
+	if hash != r.Hash {
+		return statusBehind, nil
+	}
+	return statusCurrent, nil
+}
+
+// showStatus lists, per output instance, the status of the dashboards of the
+// input instances uploaded to it.
+func showStatus(cfg *config) error {
+	if cfg.StateFile == "" {
+		return errors.New("state_file is not configured")
+	}
+	state, err := loadState(cfg.StateFile)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OUTPUT\tSOURCE\tUID\tTITLE\tSTATUS\tPROMOTED")
+	for _, instance := range cfg.Output {
+		orgInstances, err := instance.orgInstances()
+		if err != nil {
+			return err
+		}
+		for _, outputInstance := range orgInstances {
+			client, err := outputInstance.client()
+			if err != nil {
+				return err
+			}
+			inputs, err := cfg.inputsFor(outputInstance)
+			if err != nil {
+				return err
+			}
+			for _, input := range inputs {
+				dashboards, err := input.dashboards(*statusDirectory)
+				if err != nil {
+					return fmt.Errorf("error reading dashboards: %w", err)
+				}
+				for _, d := range dashboards {
+					if !outputInstance.shouldIncludeDashboard(d.Dashboard) {
+						continue
+					}
+					uid, err := getUID(d.Dashboard)
+					if err != nil {
+						return err
+					}
+					title, err := getTitle(d.Dashboard)
+					if err != nil {
+						return err
+					}
+					outputUID := outputInstance.dashboardUID(input, uid)
+					r := state.get(outputInstance, outputUID)
+					result, err := dashboardStatus(client, r, d, outputUID)
+					if err != nil {
+						return fmt.Errorf("error getting status of %s in %s: %w", uid, instanceKey(outputInstance), err)
+					}
+					var promoted string
+					if r != nil {
+						promoted = fmt.Sprintf("%s by %s", r.Timestamp.Format(time.RFC3339), r.Actor)
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", instanceKey(outputInstance), instanceKey(input), uid, title, result, promoted)
+				}
+			}
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromotionState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	output := grafanaInstance{Name: "prod"}
+	state, err := loadState(path)
+	require.NoError(t, err)
+	require.NoError(t, state.record(output, "nodes", &promotionRecord{Source: "dev", OutputVersion: 3}))
+
+	state, err = loadState(path)
+	require.NoError(t, err)
+	require.Equal(t, "dev", state.get(output, "nodes").Source)
+	require.False(t, state.drifted(output, "nodes", &gapi.Dashboard{Model: map[string]interface{}{"version": float64(3)}}))
+	require.True(t, state.drifted(output, "nodes", &gapi.Dashboard{Model: map[string]interface{}{"version": float64(4)}}))
+	require.False(t, state.drifted(output, "pods", &gapi.Dashboard{Model: map[string]interface{}{"version": float64(4)}}))
+}
+
+func TestDashboardStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/dashboards/uid/nodes" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"dashboard": {"uid": "nodes", "version": 3}, "meta": {}}`))
+	}))
+	defer server.Close()
+	client, err := gapi.New(server.URL, gapi.Config{})
+	require.NoError(t, err)
+
+	local := &FullDashboard{Dashboard: &gapi.Dashboard{Model: map[string]interface{}{"uid": "nodes", "title": "Nodes"}}}
+	hash, err := dashboardHash(local.Dashboard)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		record *promotionRecord
+		uid    string
+		status string
+	}{
+		{record: nil, uid: "nodes", status: statusNotPromoted},
+		{record: &promotionRecord{Hash: hash, OutputVersion: 3}, uid: "nodes", status: statusCurrent},
+		{record: &promotionRecord{Hash: "old", OutputVersion: 3}, uid: "nodes", status: statusBehind},
+		{record: &promotionRecord{Hash: hash, OutputVersion: 2}, uid: "nodes", status: statusDrifted},
+		// Deleted from the output instance.
+		{record: &promotionRecord{Hash: hash, OutputVersion: 3}, uid: "pods", status: statusNotPromoted},
+	} {
+		status, err := dashboardStatus(client, tc.record, local, tc.uid)
+		require.NoError(t, err)
+		require.Equal(t, tc.status, status)
+	}
+}
+
+func TestMergeDashboardOnUpload(t *testing.T) {
+	output := grafanaInstance{Name: "prod"}
+	state, err := loadState(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, err)
+	require.NoError(t, state.record(output, "nodes", &promotionRecord{
+		OutputVersion: 3,
+		Base:          mustModel(t, `{"uid": "nodes", "title": "Nodes", "panels": [{"id": 1, "title": "cpu"}]}`),
+	}))
+
+	// The source renames the dashboard, the output renames the panel.
+	local := &FullDashboard{Dashboard: &gapi.Dashboard{Model: mustModel(t, `{"uid": "nodes", "title": "Node overview", "panels": [{"id": 1, "title": "cpu"}]}`)}}
+	board := &gapi.Dashboard{Model: mustModel(t, `{"uid": "nodes", "title": "Nodes", "version": 4, "panels": [{"id": 1, "title": "CPU"}]}`)}
+	merged, err := state.mergeDashboard(output, "nodes", nil, local, board, nil)
+	require.NoError(t, err)
+	require.Equal(t, mustModel(t, `{"uid": "nodes", "title": "Node overview", "panels": [{"id": 1, "title": "CPU"}]}`), merged.Dashboard.Model)
+
+	// Both rename the panel.
+	local.Dashboard.Model["panels"] = []interface{}{map[string]interface{}{"id": float64(1), "title": "processors"}}
+	_, err = state.mergeDashboard(output, "nodes", nil, local, board, nil)
+	require.EqualError(t, err, "dashboard nodes was changed in prod since it was uploaded, and can not be merged: conflicts at /panels/id=1/title, use --prefer or --force")
+	merged, err = state.mergeDashboard(output, "nodes", nil, local, board, []string{"source"})
+	require.NoError(t, err)
+	require.Equal(t, "processors", merged.Dashboard.Model["panels"].([]interface{})[0].(map[string]interface{})["title"])
+}
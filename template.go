@@ -0,0 +1,151 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// templateRegexp matches %{name} and %{name:-default} placeholders, and %%{,
+// which is an escaped %{. Grafana uses ${var} and [[var]] for its own
+// variables, and Prometheus legends use {{label}}.
+var templateRegexp = regexp.MustCompile(`%%\{|%\{([A-Za-z_][A-Za-z0-9_.-]*)(:-[^}]*)?\}`)
+
+// renderDashboard replaces the placeholders of a dashboard, and of its library
+// panels, with the template values of the output instance. Strings which are
+// a single placeholder are replaced by the value itself, so that numbers and
+// booleans keep their type.
+func (g *grafanaInstance) renderDashboard(d *FullDashboard) error {
+	missing := make(map[string]bool)
+	d.Dashboard.Model = renderValue(d.Dashboard.Model, g.TemplateValues, missing).(map[string]interface{})
+	for _, p := range d.LibraryPanels {
+		p.Model = renderValue(p.Model, g.TemplateValues, missing).(map[string]interface{})
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	uid, _ := getUID(d.Dashboard)
+	return fmt.Errorf("dashboard %s: template values %s are not defined for %s", uid, missingNames(missing), instanceKey(*g))
+}
+
+// hasPlaceholders returns true if a value contains placeholders or escapes,
+// which are changed when it is rendered.
+func hasPlaceholders(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, item := range v {
+			if hasPlaceholders(item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if hasPlaceholders(item) {
+				return true
+			}
+		}
+	case string:
+		return templateRegexp.MatchString(v)
+	}
+	return false
+}
+
+func missingNames(missing map[string]bool) string {
+	names := make([]string, 0, len(missing))
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// renderValue replaces the placeholders of a value. Without missing, only the
+// placeholders with values are replaced, and defaults and escapes are kept
+// for a later rendering.
+func renderValue(v interface{}, values map[string]interface{}, missing map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = renderValue(item, values, missing)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = renderValue(item, values, missing)
+		}
+		return v
+	case string:
+		return renderString(v, values, missing)
+	}
+	return v
+}
+
+func renderString(s string, values map[string]interface{}, missing map[string]bool) interface{} {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	if m := templateRegexp.FindStringSubmatchIndex(s); m != nil && m[0] == 0 && m[1] == len(s) && m[2] >= 0 {
+		if value, ok := templateValue(values, s, m, missing != nil); ok {
+			return value
+		}
+		if missing != nil {
+			missing[s[m[2]:m[3]]] = true
+		}
+		return s
+	}
+	return templateRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "%%{" {
+			if missing == nil {
+				return match
+			}
+			return "%{"
+		}
+		m := templateRegexp.FindStringSubmatchIndex(match)
+		value, ok := templateValue(values, match, m, missing != nil)
+		if !ok {
+			if missing != nil {
+				missing[match[m[2]:m[3]]] = true
+			}
+			return match
+		}
+		return fmt.Sprint(value)
+	})
+}
+
+// templateValue returns the value of a placeholder, or its default.
+func templateValue(values map[string]interface{}, match string, m []int, defaults bool) (interface{}, bool) {
+	if value, ok := values[match[m[2]:m[3]]]; ok {
+		return value, true
+	}
+	if defaults && m[4] >= 0 {
+		return match[m[4]+2 : m[5]], true
+	}
+	return nil, false
+}
+
+// validateTemplateValues checks that the template values of the instance are
+// scalars.
+func (g *grafanaInstance) validateTemplateValues() error {
+	for name, value := range g.TemplateValues {
+		switch value.(type) {
+		case string, int, float64, bool:
+		default:
+			return fmt.Errorf("instance %s: template value %s must be a string, a number or a boolean", g.Name, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderDashboard(t *testing.T) {
+	d := &FullDashboard{Dashboard: &gapi.Dashboard{Model: mustModel(t, `{
+		"uid": "abc",
+		"panels": [{
+			"targets": [{"expr": "up{cluster=\"%{cluster}\"}", "legendFormat": "{{instance}} %%{x}"}],
+			"thresholds": [{"value": "%{threshold}"}],
+			"links": [{"url": "%{runbooks:-https://runbooks.example.com}/nodes"}]
+		}]}`)}}
+	output := grafanaInstance{Name: "prod", TemplateValues: map[string]interface{}{
+		"cluster":   "prod-1",
+		"threshold": 90,
+	}}
+	require.NoError(t, output.renderDashboard(d))
+	require.Equal(t, mustModel(t, `{
+		"uid": "abc",
+		"panels": [{
+			"targets": [{"expr": "up{cluster=\"prod-1\"}", "legendFormat": "{{instance}} %{x}"}],
+			"thresholds": [{"value": 90}],
+			"links": [{"url": "https://runbooks.example.com/nodes"}]
+		}]}`), mustRoundTrip(t, d.Dashboard.Model))
+
+	d.Dashboard.Model = mustModel(t, `{"uid": "abc", "title": "%{env} %{region}"}`)
+	require.EqualError(t, output.renderDashboard(d), "dashboard abc: template values env, region are not defined for prod")
+}
+
+// mustModel decodes a dashboard model.
+func mustModel(t *testing.T, s string) map[string]interface{} {
+	m := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal([]byte(s), &m))
+	return m
+}
+
+// mustWriteDashboard writes a dashboard in the General folder of an instance
+// in a dashboards directory, like fetch does.
+func mustWriteDashboard(t *testing.T, directory, instance string, model map[string]interface{}) {
+	folder := filepath.Join(directory, instance, "general")
+	require.NoError(t, os.MkdirAll(folder, os.ModePerm))
+	uid, err := getUID(&gapi.Dashboard{Model: model})
+	require.NoError(t, err)
+	require.NoError(t, writeJSON(filepath.Join(folder, uid+".json"), FullDashboard{Dashboard: &gapi.Dashboard{Model: model}}))
+}
+
+func mustRoundTrip(t *testing.T, v interface{}) map[string]interface{} {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	m := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(data, &m))
+	return m
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+)
+
+// maxUIDLength is the maximum length of Grafana UIDs.
+const maxUIDLength = 40
+
+var uidRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+// uidMappingConfig transforms the UIDs of the dashboards of an input
+// instance, or of all the input instances, in an output instance.
+type uidMappingConfig struct {
+	Input  string `yaml:"input"`
+	Prefix string `yaml:"prefix"`
+	Suffix string `yaml:"suffix"`
+	// Hash replaces the UID by a hash of the input instance and the UID.
+	Hash bool `yaml:"hash"`
+}
+
+func (g *grafanaInstance) uidMapping(input grafanaInstance) *uidMappingConfig {
+	for i := range g.UIDMappings {
+		if m := &g.UIDMappings[i]; m.Input == "" || m.Input == input.Name {
+			return m
+		}
+	}
+	return nil
+}
+
+// dashboardUID returns the UID of a dashboard of an input instance in the
+// output instance.
+func (g *grafanaInstance) dashboardUID(input grafanaInstance, uid string) string {
+	m := g.uidMapping(input)
+	if m == nil {
+		return uid
+	}
+	if m.Hash {
+		sum := sha256.Sum256([]byte(instanceKey(input) + "/" + uid))
+		uid = hex.EncodeToString(sum[:])[:maxUIDLength-len(m.Prefix)-len(m.Suffix)]
+	}
+	return m.Prefix + uid + m.Suffix
+}
+
+// validateUID checks that a UID is accepted by Grafana.
+func validateUID(uid string) error {
+	if len(uid) > maxUIDLength {
+		return fmt.Errorf("uid %s is longer than %d characters", uid, maxUIDLength)
+	}
+	if !uidRegexp.MatchString(uid) {
+		return fmt.Errorf("uid %s can only contain letters, digits, - and _", uid)
+	}
+	return nil
+}
+
+// validateUIDMappings checks that the UIDs of output instances remain valid.
+func (g *grafanaInstance) validateUIDMappings() error {
+	for _, m := range g.UIDMappings {
+		if len(m.Prefix)+len(m.Suffix) > maxUIDLength-8 {
+			return fmt.Errorf("instance %s: uid_mappings prefix and suffix are too long", g.Name)
+		}
+		if !uidRegexp.MatchString(m.Prefix + m.Suffix) {
+			return fmt.Errorf("instance %s: uid_mappings prefix and suffix can only contain letters, digits, - and _", g.Name)
+		}
+	}
+	return nil
+}
+
+// mappedUID returns the UID of a dashboard in an output instance if it
+// differs from its UID in the input instance.
+func mappedUID(sourceUID, uid string) string {
+	if sourceUID == uid {
+		return ""
+	}
+	return uid
+}
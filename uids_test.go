@@ -0,0 +1,44 @@
+// Copyright 2021 Inuits
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDashboardUID(t *testing.T) {
+	teamA := grafanaInstance{Name: "team-a"}
+	teamB := grafanaInstance{Name: "team-b"}
+	output := grafanaInstance{
+		Name: "prod",
+		UIDMappings: []uidMappingConfig{
+			{Input: "team-a", Prefix: "a-"},
+			{Hash: true, Suffix: "-x"},
+		},
+	}
+	require.Equal(t, "a-nodes", output.dashboardUID(teamA, "nodes"))
+
+	hashed := output.dashboardUID(teamB, "nodes")
+	require.Len(t, hashed, maxUIDLength)
+	require.Regexp(t, `^[0-9a-f]{38}-x$`, hashed)
+	require.Equal(t, hashed, output.dashboardUID(teamB, "nodes"))
+	require.NotEqual(t, hashed, output.dashboardUID(teamB, "pods"))
+
+	require.Equal(t, "nodes", (&grafanaInstance{}).dashboardUID(teamA, "nodes"))
+
+	long := &FullDashboard{Dashboard: &gapi.Dashboard{Model: map[string]interface{}{"uid": "kubernetes-cluster-resources-by-workload"}}}
+	require.EqualError(t, output.prepareDashboard(teamA, long), "dashboard kubernetes-cluster-resources-by-workload in prod: uid a-kubernetes-cluster-resources-by-workload is longer than 40 characters")
+}
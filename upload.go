@@ -13,17 +13,18 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/fs"
-	"io/ioutil"
-	"path/filepath"
 
 	gapi "github.com/grafana/grafana-api-golang-client"
 )
 
 func uploadDashboards(cfg *config) error {
+	err := validatePrefer(*uploadPrefer)
+	if err != nil {
+		return err
+	}
+
 	var inputInstance grafanaInstance
 	var outputInstance grafanaInstance
 	var found bool
@@ -51,95 +52,233 @@ func uploadDashboards(cfg *config) error {
 		return errors.New("input instance not found")
 	}
 
+	inputInstance, err = inputInstance.orgInstance(*uploadSourceOrg)
+	if err != nil {
+		return err
+	}
+	outputInstance, err = outputInstance.outputOrgInstance(*uploadOutputOrg, inputInstance)
+	if err != nil {
+		return err
+	}
+
 	client, err := outputInstance.client()
 	if err != nil {
 		return err
 	}
 
-	clientDS := []*gapi.DataSource{}
-	// Hard code limit to 50 for now.
-	for i := int64(0); i < 50; i++ {
-		ds, err := client.DataSource(i)
-		if err == nil {
-			clientDS = append(clientDS, ds)
-		}
+	clientDS := clientDatasources(client)
+
+	state, err := loadState(cfg.StateFile)
+	if err != nil {
+		return err
 	}
 
-	basepath := filepath.Join(*uploadDirectory, inputInstance.Name)
-	dashboards := []*FullDashboard{}
-	err = filepath.Walk(basepath, func(path string, info fs.FileInfo, err error) error {
+	basepath := inputInstance.path(*uploadDirectory)
+	dashboards, err := inputInstance.dashboards(*uploadDirectory)
+	if err != nil {
+		return err
+	}
+	claims, err := cfg.dashboardClaims(outputInstance, *uploadDirectory)
+	if err != nil {
+		return err
+	}
+	for _, dashboardUID := range *uploadDashboardsList {
+		dashboard, err := findDashboard(dashboards, dashboardUID)
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
-			return nil
-		}
-		data, err := ioutil.ReadFile(path)
+		err = claims.checkDashboardOwner(outputInstance, inputInstance, dashboard)
 		if err != nil {
 			return err
 		}
-		localDashboard := &FullDashboard{}
-		err = json.Unmarshal(data, localDashboard)
+		err = state.uploadDashboard(inputInstance, outputInstance, client, clientDS, dashboard, uploadOptions{force: *uploadForce, prefer: *uploadPrefer})
 		if err != nil {
 			return err
 		}
-		dashboards = append(dashboards, localDashboard)
-		return nil
-	})
+	}
+
+	err = uploadNotifications(outputInstance, basepath)
 	if err != nil {
 		return err
 	}
-	for _, dashboardUID := range *uploadDashboardsList {
-		var dashboard FullDashboard
-		var found bool
-		for _, d := range dashboards {
-			uid, err := getUID(d.Dashboard)
-			if err != nil {
-				return err
-			}
-			if uid == dashboardUID {
-				dashboard = *d
-				found = true
-			}
+
+	if len(*uploadRuleGroupsList) > 0 {
+		err = uploadRuleGroups(inputInstance, outputInstance, client, basepath, clientDS)
+		if err != nil {
+			return err
 		}
-		if !found {
-			return fmt.Errorf("dashboard %s not found", dashboardUID)
+	}
+	return nil
+}
+
+// uploadRuleGroups uploads the alert rule groups after the dashboards, so
+// that the dashboards linked to the rules exist. Rule groups that only exist
+// in the output instance are deleted if it purges alert rules.
+func uploadRuleGroups(inputInstance, outputInstance grafanaInstance, client *gapi.Client, basepath string, clientDS []*gapi.DataSource) error {
+	api, err := outputInstance.api()
+	if err != nil {
+		return err
+	}
+	localGroups, err := readRuleGroups(basepath)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range *uploadRuleGroupsList {
+		folderTitle, title, err := splitRuleGroupKey(key)
+		if err != nil {
+			return err
 		}
 
-		if dashboard.Folder != nil && dashboard.Folder.ID != 0 {
-			folders, err := client.Folders()
-			if err != nil {
-				return err
+		var group *FullRuleGroup
+		for _, g := range localGroups {
+			if g.Folder.Title == folderTitle && g.Group.Title == title {
+				group = g
+				break
 			}
-			var found bool
-			for _, f := range folders {
-				if f.Title == dashboard.Folder.Title {
-					dashboard.Dashboard.Meta.Folder = f.ID
-					dashboard.Dashboard.Folder = f.ID
-					found = true
-					break
-				}
+		}
+
+		if group == nil {
+			if !outputInstance.PurgeAlertRules {
+				return fmt.Errorf("alert rule group %s not found", key)
 			}
-			if !found {
-				folder, err := client.NewFolder(dashboard.Folder.Title)
-				if err != nil {
-					return err
-				}
-				dashboard.Dashboard.Meta.Folder = folder.ID
-				dashboard.Dashboard.Folder = folder.ID
-				dashboard.Dashboard.Meta.Slug = ""
+			err = deleteOutputRuleGroup(api, client, folderTitle, title)
+			if err != nil {
+				return fmt.Errorf("error deleting alert rule group %s: %v", key, err)
 			}
+			continue
 		}
 
-		dashboard.Dashboard.Model["id"] = 0
-		dashboard.Dashboard.Overwrite = true
+		folder, _, err := outputFolder(client, folderTitle)
+		if err != nil {
+			return err
+		}
+		changeRuleGroupDatasources(group.Group, group.Datasources, clientDS)
+		changeRuleGroupDashboards(group.Group, func(uid string) string {
+			return outputInstance.dashboardUID(inputInstance, uid)
+		})
+		prepareRuleGroup(group.Group, folder.UID)
+		err = putRuleGroup(api, group.Group)
+		if err != nil {
+			return fmt.Errorf("error uploading alert rule group %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func deleteOutputRuleGroup(api *apiClient, client *gapi.Client, folderTitle, title string) error {
+	groups, err := ruleGroups(api)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.Title != title {
+			continue
+		}
+		folder, err := client.FolderByUID(g.FolderUID)
+		if err != nil {
+			return err
+		}
+		if folder.Title == folderTitle {
+			return deleteRuleGroup(api, g)
+		}
+	}
+	return errors.New("not found")
+}
 
-		changeDatasources(dashboard.Dashboard, dashboard.Datasources, clientDS)
+// findDashboard returns the dashboard with the given UID.
+func findDashboard(dashboards []*FullDashboard, dashboardUID string) (*FullDashboard, error) {
+	for _, d := range dashboards {
+		uid, err := getUID(d.Dashboard)
+		if err != nil {
+			return nil, err
+		}
+		if uid == dashboardUID {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("dashboard %s not found", dashboardUID)
+}
 
-		_, err = client.NewDashboard(*dashboard.Dashboard)
+// uploadDashboard uploads a dashboard, and the library panels it uses, to an
+// output instance.
+func uploadDashboard(client *gapi.Client, clientDS []*gapi.DataSource, dashboard FullDashboard) (*gapi.DashboardSaveResponse, error) {
+	dashboardUID, err := getUID(dashboard.Dashboard)
+	if err != nil {
+		return nil, err
+	}
+
+	if dashboard.Folder != nil && dashboard.Folder.ID != 0 {
+		folder, created, err := outputFolder(client, dashboard.Folder.Title)
 		if err != nil {
-			return fmt.Errorf("error uploading %s: %v", dashboardUID, err)
+			return nil, err
+		}
+		dashboard.Dashboard.Meta.Folder = folder.ID
+		dashboard.Dashboard.Folder = folder.ID
+		if created {
+			dashboard.Dashboard.Meta.Slug = ""
 		}
 	}
-	return nil
+
+	for _, p := range dashboard.LibraryPanels {
+		changeLibraryPanelDatasources(p, dashboard.Datasources, clientDS)
+		err = uploadLibraryPanel(client, p)
+		if err != nil {
+			return nil, fmt.Errorf("error uploading library panel %s for %s: %v", p.UID, dashboardUID, err)
+		}
+	}
+
+	dashboard.Dashboard.Model["id"] = 0
+	dashboard.Dashboard.Overwrite = true
+
+	changeDatasources(dashboard.Dashboard, dashboard.Datasources, clientDS)
+
+	resp, err := client.NewDashboard(*dashboard.Dashboard)
+	if err != nil {
+		return nil, fmt.Errorf("error uploading %s: %v", dashboardUID, err)
+	}
+	return resp, nil
+}
+
+// outputFolder returns the folder of the output instance with the given
+// title, creating it if needed.
+func outputFolder(client *gapi.Client, title string) (folder gapi.Folder, created bool, err error) {
+	folders, err := client.Folders()
+	if err != nil {
+		return folder, false, err
+	}
+	for _, f := range folders {
+		if f.Title == title {
+			return f, false, nil
+		}
+	}
+	folder, err = client.NewFolder(title)
+	return folder, true, err
+}
+
+// uploadLibraryPanel creates or updates a library panel in the output
+// instance, so that the dashboards referencing it by UID can be uploaded.
+func uploadLibraryPanel(client *gapi.Client, panel *gapi.LibraryPanel) error {
+	p := *panel
+	p.ID = 0
+	p.Folder = 0
+	if p.Meta.FolderUID != "" {
+		folder, _, err := outputFolder(client, p.Meta.FolderName)
+		if err != nil {
+			return err
+		}
+		p.Folder = folder.ID
+	}
+
+	existing, err := client.LibraryPanelByUID(p.UID)
+	if isNotFound(err) {
+		_, err = client.NewLibraryPanel(p)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	p.Version = existing.Version
+	_, err = client.PatchLibraryPanel(p.UID, p)
+	return err
 }